@@ -1,26 +1,116 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
-	"net/http"
+	"io"
+	"io/ioutil"
 	"time"
 
 	"github.com/pogointel/opm/opm"
+	"github.com/pogointel/opm/util"
 )
 
-var abuseCounter = make(map[string]int)
+// submitResult is the result for a single object of a batch submission
+type submitResult struct {
+	Ok    bool
+	ID    string `json:",omitempty"`
+	Error string `json:",omitempty"`
+}
+
+// submitResponse is sent back for batch submissions
+type submitResponse struct {
+	Ok       bool
+	Accepted int
+	Rejected int
+	Results  []submitResult
+}
+
+// maxSubmitBatchSize is the maximum number of objects accepted in a single /submit request
+const maxSubmitBatchSize = 1000
+
+// maxSubmitBodySize is the maximum size of a /submit request body in bytes
+const maxSubmitBodySize = 4 << 20
+
+// splitWebhookBody splits the body of a submit request into single webhook messages.
+// The body can be a single json object, a json array or newline delimited json (NDJSON).
+// The second return value reports whether the body contained a batch.
+// Malformed lines of NDJSON are returned as they are, so they can be rejected one by one.
+func splitWebhookBody(r io.Reader) ([]json.RawMessage, bool, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, false, opm.ErrInvalidWebhook
+	}
+	data = bytes.TrimSpace(data)
+	if len(data) == 0 {
+		return nil, false, opm.ErrInvalidWebhook
+	}
+	// JSON array
+	if data[0] == '[' {
+		var messages []json.RawMessage
+		if err := json.Unmarshal(data, &messages); err != nil {
+			return nil, true, opm.ErrInvalidWebhook
+		}
+		return messages, true, nil
+	}
+	// Single object or NDJSON
+	var messages []json.RawMessage
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	for {
+		var m json.RawMessage
+		err := decoder.Decode(&m)
+		if err == io.EOF {
+			return messages, len(messages) > 1, nil
+		}
+		if err != nil {
+			break
+		}
+		messages = append(messages, m)
+	}
+	// Malformed NDJSON. Every line is a message, so the broken ones are rejected on their own.
+	messages = messages[:0]
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) > 0 {
+			messages = append(messages, json.RawMessage(line))
+		}
+	}
+	return messages, len(messages) > 1, nil
+}
 
-func objectFromWebhook(format string, r *http.Request) (opm.MapObject, error) {
+func objectFromWebhook(format string, data []byte) (opm.MapObject, error) {
 	var object opm.MapObject
 	switch format {
 	case "pgm":
 		// PokemonGo-Map format
 		var pgmMessage PGMWebhookFormat
-		err := json.NewDecoder(r.Body).Decode(&pgmMessage)
+		err := json.Unmarshal(data, &pgmMessage)
 		if err != nil || pgmMessage.Type != "pokemon" {
 			return object, opm.ErrInvalidWebhook
 		}
 		object = pgmMessage.MapObject()
+	case "rm":
+		// RocketMap format
+		var rmMessage RMWebhookFormat
+		err := json.Unmarshal(data, &rmMessage)
+		if err != nil {
+			return object, opm.ErrInvalidWebhook
+		}
+		return rmMessage.MapObject()
+	case "monocle":
+		// Monocle format
+		var monocleMessage MonocleWebhookFormat
+		err := json.Unmarshal(data, &monocleMessage)
+		if err != nil {
+			return object, opm.ErrInvalidWebhook
+		}
+		return monocleMessage.MapObject()
+	case "opm":
+		// Native format (opm.MapObject as json)
+		err := json.Unmarshal(data, &object)
+		if err != nil {
+			return object, opm.ErrInvalidWebhook
+		}
 	default:
 		return object, opm.ErrInvalidWebhook
 	}
@@ -28,11 +118,24 @@ func objectFromWebhook(format string, r *http.Request) (opm.MapObject, error) {
 }
 
 func validateMapObject(object opm.MapObject, key opm.APIKey) error {
-	if object.Expiry < time.Now().Unix() {
-		return opm.ErrPokemonExpired
+	if object.ID == "" || object.Lat < -90 || object.Lat > 90 || object.Lng < -180 || object.Lng > 180 {
+		return opm.ErrInvalidWebhook
+	}
+	if len(key.Regions) > 0 && !util.InRegions(object.Lat, object.Lng, key.Regions) {
+		return opm.ErrOutOfRegion
 	}
-	if object.Expiry > time.Now().Add(15*time.Minute).Unix() {
-		return opm.ErrPokemonFuture
+	switch object.Type {
+	case opm.POKEMON:
+		if object.Expiry < time.Now().Unix() {
+			return opm.ErrPokemonExpired
+		}
+		if object.Expiry > time.Now().Add(15*time.Minute).Unix() {
+			return opm.ErrPokemonFuture
+		}
+	case opm.POKESTOP, opm.GYM:
+		// Forts don't expire
+	default:
+		return opm.ErrInvalidWebhook
 	}
 	return nil
 }
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSplitWebhookBody(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		messages []string
+		batch    bool
+		err      bool
+	}{
+		{"object", `{"a":1}`, []string{`{"a":1}`}, false, false},
+		{"array", `[{"a":1},{"a":2}]`, []string{`{"a":1}`, `{"a":2}`}, true, false},
+		{"ndjson", "{\"a\":1}\n{\"a\":2}\n", []string{`{"a":1}`, `{"a":2}`}, true, false},
+		{"malformed line", "{\"a\":1}\n{\"a\":\n{\"a\":3}", []string{`{"a":1}`, `{"a":`, `{"a":3}`}, true, false},
+		{"blank lines", "{\"a\":1}\n\n  \n{\"a\":\n", []string{`{"a":1}`, `{"a":`}, true, false},
+		{"malformed array", `[{"a":1},`, nil, true, true},
+		{"empty", "  \n", nil, false, true},
+	}
+	for _, test := range tests {
+		messages, batch, err := splitWebhookBody(strings.NewReader(test.body))
+		if (err != nil) != test.err {
+			t.Errorf("%s: got error %v", test.name, err)
+			continue
+		}
+		if batch != test.batch {
+			t.Errorf("%s: got batch=%v, want %v", test.name, batch, test.batch)
+		}
+		if len(messages) != len(test.messages) {
+			t.Errorf("%s: got %d messages, want %d", test.name, len(messages), len(test.messages))
+			continue
+		}
+		for i, m := range messages {
+			if string(m) != test.messages[i] {
+				t.Errorf("%s: message %d is %s, want %s", test.name, i, m, test.messages[i])
+			}
+		}
+	}
+}
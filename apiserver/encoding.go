@@ -0,0 +1,241 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"math"
+	"net/http"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/pogointel/opm/opm"
+)
+
+// Response formats for /cache and /scan
+const (
+	formatJSON    = "json"
+	formatGeoJSON = "geojson"
+	formatMsgpack = "msgpack"
+)
+
+var formatContentTypes = map[string]string{
+	formatJSON:    "application/json",
+	formatGeoJSON: "application/geo+json",
+	formatMsgpack: "application/msgpack",
+}
+
+// responseFormat selects the format of the response by the format parameter or the Accept header.
+// The parameter is only read from the query string, so the body of proxied requests stays untouched.
+func responseFormat(r *http.Request) string {
+	if f := r.URL.Query().Get("format"); f != "" {
+		if _, ok := formatContentTypes[f]; ok {
+			return f
+		}
+		return formatJSON
+	}
+	accept := r.Header.Get("Accept")
+	switch {
+	case strings.Contains(accept, "application/geo+json"):
+		return formatGeoJSON
+	case strings.Contains(accept, "application/msgpack"), strings.Contains(accept, "application/x-msgpack"):
+		return formatMsgpack
+	}
+	return formatJSON
+}
+
+// compressedWriter wraps w with the best compression the client accepts (brotli or gzip)
+func compressedWriter(w http.ResponseWriter, r *http.Request) io.WriteCloser {
+	w.Header().Add("Vary", "Accept, Accept-Encoding")
+	accept := r.Header.Get("Accept-Encoding")
+	switch {
+	case strings.Contains(accept, "br"):
+		w.Header().Set("Content-Encoding", "br")
+		return brotli.NewWriterLevel(w, 5)
+	case strings.Contains(accept, "gzip"):
+		w.Header().Set("Content-Encoding", "gzip")
+		return gzip.NewWriter(w)
+	}
+	return nopWriteCloser{w}
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// encodeAPIResponse writes the response in the given format
+func encodeAPIResponse(w io.Writer, format string, response opm.APIResponse) error {
+	switch format {
+	case formatGeoJSON:
+		return json.NewEncoder(w).Encode(newFeatureCollection(response))
+	case formatMsgpack:
+		_, err := w.Write(msgpackAPIResponse(response))
+		return err
+	}
+	return json.NewEncoder(w).Encode(response)
+}
+
+// featureCollection is a GeoJSON FeatureCollection of MapObjects.
+// Ok, Error and the scan queue state are added as foreign members.
+type featureCollection struct {
+	Type          string    `json:"type"`
+	Ok            bool      `json:"ok"`
+	Error         string    `json:"error,omitempty"`
+	FreshAsOf     int64     `json:"fresh_as_of,omitempty"`
+	QueuePosition int       `json:"queue_position,omitempty"`
+	EstimatedWait int       `json:"estimated_wait,omitempty"`
+	Features      []feature `json:"features"`
+}
+
+type feature struct {
+	Type       string          `json:"type"`
+	ID         string          `json:"id"`
+	Geometry   pointGeometry   `json:"geometry"`
+	Properties featureProperty `json:"properties"`
+}
+
+type pointGeometry struct {
+	Type        string     `json:"type"`
+	Coordinates [2]float64 `json:"coordinates"`
+}
+
+type featureProperty struct {
+	Type      int    `json:"type"`
+	PokemonID int    `json:"pokemonID,omitempty"`
+	Expiry    int64  `json:"expiry,omitempty"`
+	Lured     bool   `json:"lured,omitempty"`
+	Team      int    `json:"team,omitempty"`
+	Source    string `json:"source,omitempty"`
+}
+
+func newFeatureCollection(response opm.APIResponse) featureCollection {
+	fc := featureCollection{
+		Type:          "FeatureCollection",
+		Ok:            response.Ok,
+		Error:         response.Error,
+		FreshAsOf:     response.FreshAsOf,
+		QueuePosition: response.QueuePosition,
+		EstimatedWait: response.EstimatedWait,
+		Features:      make([]feature, len(response.MapObjects)),
+	}
+	for i, o := range response.MapObjects {
+		fc.Features[i] = feature{
+			Type: "Feature",
+			ID:   o.ID,
+			// GeoJSON uses lng,lat order
+			Geometry: pointGeometry{Type: "Point", Coordinates: [2]float64{o.Lng, o.Lat}},
+			Properties: featureProperty{
+				Type:      o.Type,
+				PokemonID: o.PokemonID,
+				Expiry:    o.Expiry,
+				Lured:     o.Lured,
+				Team:      o.Team,
+				Source:    o.Source,
+			},
+		}
+	}
+	return fc
+}
+
+// msgpackAPIResponse encodes a response as MessagePack map {"ok", "error", "freshAsOf", "queuePosition", "estimatedWait", "objects"}.
+// To keep it small every MapObject is an array: [type, id, lat, lng, pokemonID, expiry, lured, team, source]
+func msgpackAPIResponse(response opm.APIResponse) []byte {
+	var m msgpackWriter
+	m.mapHeader(6)
+	m.str("ok")
+	m.boolean(response.Ok)
+	m.str("error")
+	m.str(response.Error)
+	m.str("freshAsOf")
+	m.int(response.FreshAsOf)
+	m.str("queuePosition")
+	m.int(int64(response.QueuePosition))
+	m.str("estimatedWait")
+	m.int(int64(response.EstimatedWait))
+	m.str("objects")
+	m.arrayHeader(len(response.MapObjects))
+	for _, o := range response.MapObjects {
+		m.arrayHeader(9)
+		m.int(int64(o.Type))
+		m.str(o.ID)
+		m.float(o.Lat)
+		m.float(o.Lng)
+		m.int(int64(o.PokemonID))
+		m.int(o.Expiry)
+		m.boolean(o.Lured)
+		m.int(int64(o.Team))
+		m.str(o.Source)
+	}
+	return m.buf
+}
+
+// msgpackWriter implements the parts of MessagePack that are needed for APIResponses
+type msgpackWriter struct {
+	buf []byte
+}
+
+func (m *msgpackWriter) header(fix byte, fixMax int, b16, b32 byte, n int) {
+	switch {
+	case n <= fixMax:
+		m.buf = append(m.buf, fix|byte(n))
+	case n <= math.MaxUint16:
+		m.buf = append(m.buf, b16)
+		m.buf = binary.BigEndian.AppendUint16(m.buf, uint16(n))
+	default:
+		m.buf = append(m.buf, b32)
+		m.buf = binary.BigEndian.AppendUint32(m.buf, uint32(n))
+	}
+}
+
+func (m *msgpackWriter) mapHeader(n int) {
+	m.header(0x80, 15, 0xde, 0xdf, n)
+}
+
+func (m *msgpackWriter) arrayHeader(n int) {
+	m.header(0x90, 15, 0xdc, 0xdd, n)
+}
+
+func (m *msgpackWriter) str(s string) {
+	if len(s) > 31 && len(s) <= math.MaxUint8 {
+		m.buf = append(m.buf, 0xd9, byte(len(s)))
+	} else {
+		m.header(0xa0, 31, 0xda, 0xdb, len(s))
+	}
+	m.buf = append(m.buf, s...)
+}
+
+func (m *msgpackWriter) boolean(b bool) {
+	if b {
+		m.buf = append(m.buf, 0xc3)
+	} else {
+		m.buf = append(m.buf, 0xc2)
+	}
+}
+
+func (m *msgpackWriter) int(i int64) {
+	switch {
+	case i >= 0 && i <= 127:
+		m.buf = append(m.buf, byte(i))
+	case i < 0 && i >= -32:
+		m.buf = append(m.buf, byte(int8(i)))
+	case i > 0 && i <= math.MaxUint8:
+		m.buf = append(m.buf, 0xcc, byte(i))
+	case i > 0 && i <= math.MaxUint16:
+		m.buf = append(m.buf, 0xcd)
+		m.buf = binary.BigEndian.AppendUint16(m.buf, uint16(i))
+	case i >= math.MinInt32 && i <= math.MaxInt32:
+		m.buf = append(m.buf, 0xd2)
+		m.buf = binary.BigEndian.AppendUint32(m.buf, uint32(int32(i)))
+	default:
+		m.buf = append(m.buf, 0xd3)
+		m.buf = binary.BigEndian.AppendUint64(m.buf, uint64(i))
+	}
+}
+
+func (m *msgpackWriter) float(f float64) {
+	m.buf = append(m.buf, 0xcb)
+	m.buf = binary.BigEndian.AppendUint64(m.buf, math.Float64bits(f))
+}
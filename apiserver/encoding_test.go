@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/pogointel/opm/opm"
+)
+
+func TestMsgpackWriter(t *testing.T) {
+	tests := []struct {
+		name  string
+		write func(m *msgpackWriter)
+		want  []byte
+	}{
+		{"positive fixint", func(m *msgpackWriter) { m.int(5) }, []byte{0x05}},
+		{"negative fixint", func(m *msgpackWriter) { m.int(-1) }, []byte{0xff}},
+		{"uint8", func(m *msgpackWriter) { m.int(200) }, []byte{0xcc, 0xc8}},
+		{"uint16", func(m *msgpackWriter) { m.int(1000) }, []byte{0xcd, 0x03, 0xe8}},
+		{"int32", func(m *msgpackWriter) { m.int(-100) }, []byte{0xd2, 0xff, 0xff, 0xff, 0x9c}},
+		{"int64", func(m *msgpackWriter) { m.int(1 << 40) }, []byte{0xd3, 0, 0, 1, 0, 0, 0, 0, 0}},
+		{"true", func(m *msgpackWriter) { m.boolean(true) }, []byte{0xc3}},
+		{"false", func(m *msgpackWriter) { m.boolean(false) }, []byte{0xc2}},
+		{"float", func(m *msgpackWriter) { m.float(1.5) }, []byte{0xcb, 0x3f, 0xf8, 0, 0, 0, 0, 0, 0}},
+		{"fixstr", func(m *msgpackWriter) { m.str("ok") }, []byte{0xa2, 'o', 'k'}},
+		{"empty str", func(m *msgpackWriter) { m.str("") }, []byte{0xa0}},
+		{"fixmap", func(m *msgpackWriter) { m.mapHeader(6) }, []byte{0x86}},
+		{"array16", func(m *msgpackWriter) { m.arrayHeader(16) }, []byte{0xdc, 0x00, 0x10}},
+		{"array32", func(m *msgpackWriter) { m.arrayHeader(1 << 16) }, []byte{0xdd, 0, 1, 0, 0}},
+	}
+	for _, test := range tests {
+		var m msgpackWriter
+		test.write(&m)
+		if !bytes.Equal(m.buf, test.want) {
+			t.Errorf("%s: got % x, want % x", test.name, m.buf, test.want)
+		}
+	}
+}
+
+func TestMsgpackWriterStrings(t *testing.T) {
+	tests := []struct {
+		length int
+		header []byte
+	}{
+		{31, []byte{0xbf}},
+		{32, []byte{0xd9, 32}},
+		{255, []byte{0xd9, 255}},
+		{256, []byte{0xda, 0x01, 0x00}},
+		{1 << 16, []byte{0xdb, 0, 1, 0, 0}},
+	}
+	for _, test := range tests {
+		var m msgpackWriter
+		s := strings.Repeat("x", test.length)
+		m.str(s)
+		want := append(test.header, s...)
+		if !bytes.Equal(m.buf, want) {
+			t.Errorf("string of %d bytes: got header % x, want % x", test.length, m.buf[:len(test.header)], test.header)
+		}
+	}
+}
+
+func TestMsgpackAPIResponse(t *testing.T) {
+	b := msgpackAPIResponse(opm.APIResponse{Ok: true, MapObjects: []opm.MapObject{{Type: opm.GYM, ID: "g", Team: 2}}})
+	want := []byte{0x86,
+		0xa2, 'o', 'k', 0xc3,
+		0xa5, 'e', 'r', 'r', 'o', 'r', 0xa0,
+		0xa9, 'f', 'r', 'e', 's', 'h', 'A', 's', 'O', 'f', 0x00,
+		0xad, 'q', 'u', 'e', 'u', 'e', 'P', 'o', 's', 'i', 't', 'i', 'o', 'n', 0x00,
+		0xad, 'e', 's', 't', 'i', 'm', 'a', 't', 'e', 'd', 'W', 'a', 'i', 't', 0x00,
+		0xa7, 'o', 'b', 'j', 'e', 'c', 't', 's', 0x91,
+		0x99, 0x03, 0xa1, 'g', 0xcb, 0, 0, 0, 0, 0, 0, 0, 0, 0xcb, 0, 0, 0, 0, 0, 0, 0, 0, 0x00, 0x00, 0xc2, 0x02, 0xa0,
+	}
+	if !bytes.Equal(b, want) {
+		t.Errorf("got % x\nwant % x", b, want)
+	}
+}
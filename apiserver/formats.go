@@ -1,6 +1,13 @@
 package main
 
-import "github.com/pogointel/opm/opm"
+import (
+	"encoding/base64"
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/pogointel/opm/opm"
+)
 
 // PGMWebhookFormat is the format for incoming webhooks from PokemonGo-Map
 type PGMWebhookFormat struct {
@@ -25,3 +32,135 @@ func (p PGMWebhookFormat) MapObject() opm.MapObject {
 		Lng:       p.Message.Lng,
 	}
 }
+
+// RMWebhookFormat is the format for incoming webhooks from RocketMap.
+// The content of Message depends on Type (pokemon, gym or pokestop).
+type RMWebhookFormat struct {
+	Message json.RawMessage `json:"message"`
+	Type    string          `json:"type"`
+}
+
+type rmPokemonMessage struct {
+	EncounterID   string  `json:"encounter_id"`
+	SpawnpointID  string  `json:"spawnpoint_id"`
+	PokemonID     int     `json:"pokemon_id"`
+	DisappearTime int64   `json:"disappear_time"`
+	Lat           float64 `json:"latitude"`
+	Lng           float64 `json:"longitude"`
+}
+
+type rmGymMessage struct {
+	GymID string  `json:"gym_id"`
+	Team  int     `json:"team_id"`
+	Lat   float64 `json:"latitude"`
+	Lng   float64 `json:"longitude"`
+}
+
+type rmPokestopMessage struct {
+	PokestopID     string  `json:"pokestop_id"`
+	LureExpiration int64   `json:"lure_expiration"`
+	Lat            float64 `json:"latitude"`
+	Lng            float64 `json:"longitude"`
+}
+
+// MapObject converts a RMWebhookFormat to a opm.MapObject
+func (m RMWebhookFormat) MapObject() (opm.MapObject, error) {
+	switch m.Type {
+	case "pokemon":
+		var p rmPokemonMessage
+		if err := json.Unmarshal(m.Message, &p); err != nil {
+			return opm.MapObject{}, opm.ErrInvalidWebhook
+		}
+		return opm.MapObject{
+			Type:         opm.POKEMON,
+			ID:           rmEncounterID(p.EncounterID),
+			PokemonID:    p.PokemonID,
+			SpawnpointID: p.SpawnpointID,
+			Expiry:       p.DisappearTime,
+			Lat:          p.Lat,
+			Lng:          p.Lng,
+		}, nil
+	case "gym":
+		var g rmGymMessage
+		if err := json.Unmarshal(m.Message, &g); err != nil {
+			return opm.MapObject{}, opm.ErrInvalidWebhook
+		}
+		return opm.MapObject{
+			Type: opm.GYM,
+			ID:   g.GymID,
+			Team: g.Team,
+			Lat:  g.Lat,
+			Lng:  g.Lng,
+		}, nil
+	case "pokestop":
+		var s rmPokestopMessage
+		if err := json.Unmarshal(m.Message, &s); err != nil {
+			return opm.MapObject{}, opm.ErrInvalidWebhook
+		}
+		return opm.MapObject{
+			Type:  opm.POKESTOP,
+			ID:    s.PokestopID,
+			Lured: s.LureExpiration > time.Now().Unix(),
+			Lat:   s.Lat,
+			Lng:   s.Lng,
+		}, nil
+	}
+	return opm.MapObject{}, opm.ErrInvalidWebhook
+}
+
+// rmEncounterID converts the base64 encoded encounter ids used by RocketMap
+// to the base36 ids the scanner uses, so the same Pokemon isn't stored twice.
+func rmEncounterID(id string) string {
+	decoded, err := base64.StdEncoding.DecodeString(id)
+	if err != nil {
+		return id
+	}
+	n, err := strconv.ParseUint(string(decoded), 10, 64)
+	if err != nil {
+		return id
+	}
+	return strconv.FormatUint(n, 36)
+}
+
+// MonocleWebhookFormat is the format for incoming webhooks from Monocle
+type MonocleWebhookFormat struct {
+	Message struct {
+		EncounterID     uint64  `json:"encounter_id"`
+		PokemonID       int     `json:"pokemon_id"`
+		SpawnID         int64   `json:"spawn_id"`
+		ExpireTimestamp int64   `json:"expire_timestamp"`
+		ExternalID      string  `json:"external_id"`
+		Team            int     `json:"team"`
+		LureExpiration  int64   `json:"lure_expiration"`
+		Lat             float64 `json:"lat"`
+		Lng             float64 `json:"lon"`
+	} `json:"message"`
+	Type string `json:"type"`
+}
+
+// MapObject converts a MonocleWebhookFormat to a opm.MapObject
+func (m MonocleWebhookFormat) MapObject() (opm.MapObject, error) {
+	object := opm.MapObject{
+		Lat: m.Message.Lat,
+		Lng: m.Message.Lng,
+	}
+	switch m.Type {
+	case "pokemon":
+		object.Type = opm.POKEMON
+		object.ID = strconv.FormatUint(m.Message.EncounterID, 36)
+		object.PokemonID = m.Message.PokemonID
+		object.SpawnpointID = strconv.FormatInt(m.Message.SpawnID, 16)
+		object.Expiry = m.Message.ExpireTimestamp
+	case "gym":
+		object.Type = opm.GYM
+		object.ID = m.Message.ExternalID
+		object.Team = m.Message.Team
+	case "pokestop":
+		object.Type = opm.POKESTOP
+		object.ID = m.Message.ExternalID
+		object.Lured = m.Message.LureExpiration > time.Now().Unix()
+	default:
+		return object, opm.ErrInvalidWebhook
+	}
+	return object, nil
+}
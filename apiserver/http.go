@@ -1,39 +1,51 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
+	"expvar"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net/http"
-	"net/http/httputil"
 	"net/url"
 	"strconv"
 	"strings"
 	"time"
 
+	"gopkg.in/mgo.v2"
+
 	"github.com/pogointel/opm/opm"
+	"github.com/pogointel/opm/util"
 )
 
 var securityCheck = func(w http.ResponseWriter, r *http.Request) bool {
-	return true
+	return verifiers.Verify(r) == nil
 }
 
 func startHTTP() {
 	// Routes/Handlers
 	mux := http.NewServeMux()
-	scanHandler, err := createScanProxy()
-	if err != nil {
-		log.Fatal(err)
-	}
+	rateLimiters = newRouteLimiters(apiSettings)
+	expvar.Publish("rate_limits", rateLimiters)
 	mux.Handle("/fe/", http.StripPrefix("/fe/", http.FileServer(http.Dir(apiSettings.StaticFilesDir))))
-	mux.HandleFunc("/scan", httpDecorator(scanHandler.ServeHTTP))
+	mux.HandleFunc("/scan", httpDecorator(asyncScans(publishScanResults(scanners))))
+	mux.HandleFunc("/scan/", httpDecorator(scanJobHandler))
 	mux.HandleFunc("/cache", httpDecorator(cacheHandler))
 	mux.HandleFunc("/submit", httpDecorator(submitHandler))
+	mux.HandleFunc("/live", httpDecorator(live.ServeHTTP))
+	mux.HandleFunc("/admin/blacklist", httpDecorator(blacklistHandler))
+	mux.HandleFunc("/admin/keys", httpDecorator(keysHandler))
+	mux.HandleFunc("/admin/keys/rotate", httpDecorator(rotateKeyHandler))
+	mux.HandleFunc("/keys/rotate", httpDecorator(rotateKeyHandler))
+	mux.HandleFunc("/keys/register", httpDecorator(registerKeyHandler))
+	mux.HandleFunc("/token", httpDecorator(tokenHandler))
+	mux.HandleFunc("/challenge", httpDecorator(challengeHandler))
 	mux.Handle("/debug/vars", http.DefaultServeMux)
 	// Create http server with timeouts
 	s := http.Server{
 		ReadTimeout:  10 * time.Second,
-		WriteTimeout: 30 * time.Second,
+		WriteTimeout: writeTimeout,
 		Addr:         fmt.Sprintf(":%d", 8080),
 		Handler:      mux,
 	}
@@ -42,25 +54,44 @@ func startHTTP() {
 	log.Fatal(s.ListenAndServe())
 }
 
+// writeTimeout is the time the server has for writing a response
+const writeTimeout = 30 * time.Second
+
 func httpDecorator(inner func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		// Log start
 		start := time.Now()
-		// Check if request is ok
+		// Metadata
+		remoteAddr := clientIP(r)
+		// Check blacklist
+		if blacklist.Blocked(remoteAddr) {
+			w.WriteHeader(http.StatusForbidden)
+			apiMetrics.BlockedRequestsPerMinute.Incr(1)
+			return
+		}
+		// Rate limits
+		if !rateLimiters.AllowIP(w, r, remoteAddr) {
+			w.WriteHeader(http.StatusTooManyRequests)
+			apiMetrics.RateLimitedRequestsPerMinute.Incr(1)
+			return
+		}
+		// Check if request is ok, after the cheap checks
 		if !securityCheck(w, r) {
 			apiMetrics.SecurityCheckFailsPerMinute.Incr(1)
 			w.WriteHeader(http.StatusForbidden)
 			return
 		}
-		// Metadata
-		remoteAddr := r.RemoteAddr
-		if r.Header.Get("CF-Connecting-IP") != "" {
-			remoteAddr = r.Header.Get("CF-Connecting-IP")
+		// API key scopes and quotas
+		r, status, err := checkKey(r)
+		if err != nil {
+			w.WriteHeader(status)
+			fmt.Fprintln(w, err)
+			return
 		}
-		// Check blacklist
-		if blacklist[remoteAddr] {
-			w.WriteHeader(http.StatusForbidden)
-			apiMetrics.BlockedRequestsPerMinute.Incr(1)
+		// Key buckets are only charged for authenticated keys
+		if auth := requestAuth(r); auth != nil && !rateLimiters.AllowKey(w, r, auth.Key.PublicKey) {
+			w.WriteHeader(http.StatusTooManyRequests)
+			apiMetrics.RateLimitedRequestsPerMinute.Incr(1)
 			return
 		}
 		// ACAO
@@ -85,145 +116,404 @@ func httpDecorator(inner func(http.ResponseWriter, *http.Request)) func(http.Res
 	}
 }
 
-func createScanProxy() (http.Handler, error) {
-	targetURL, err := url.Parse(fmt.Sprintf("http://%s:%d", opmSettings.ScannerListenAddress, opmSettings.ScannerListenPort))
-	if err != nil {
-		return nil, err
+// clientIP returns the address of the client that sent the request
+func clientIP(r *http.Request) string {
+	return ipResolver.ClientIP(r)
+}
+
+// responseRecorder buffers a response, so it can be checked and encoded again
+type responseRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (r *responseRecorder) Header() http.Header {
+	return r.header
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	r.status = status
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	return r.body.Write(b)
+}
+
+// publishScanResults publishes the MapObjects of successful scans and writes the response in the format the client asked for
+func publishScanResults(inner http.Handler) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Keep a copy of the request body for the scan location
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 1<<16))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		recorder := &responseRecorder{header: make(http.Header), status: http.StatusOK}
+		inner.ServeHTTP(recorder, r)
+		var response opm.APIResponse
+		if recorder.status != http.StatusOK || json.Unmarshal(recorder.body.Bytes(), &response) != nil {
+			// Pass anything else on as it is
+			for k, v := range recorder.header {
+				w.Header()[k] = v
+			}
+			w.WriteHeader(recorder.status)
+			w.Write(recorder.body.Bytes())
+			return
+		}
+		if v := recorder.header.Get("Retry-After"); v != "" {
+			w.Header().Set("Retry-After", v)
+		}
+		writeAPIResopnse(w, r, response)
+		// Shared results were already published by the request that started the scan
+		if response.Ok && response.FreshAsOf == 0 {
+			publishMapObjects(response.MapObjects)
+			// Cross-check submissions
+			form, _ := url.ParseQuery(string(body))
+			lat, latErr := strconv.ParseFloat(form.Get("lat"), 64)
+			lng, lngErr := strconv.ParseFloat(form.Get("lng"), 64)
+			if latErr == nil && lngErr == nil {
+				reputation.Scanned(lat, lng, response.MapObjects)
+			}
+		}
 	}
-	return httputil.NewSingleHostReverseProxy(targetURL), nil
 }
 
 func submitHandler(w http.ResponseWriter, r *http.Request) {
 	// Helper function for sending http.StatusBadRequest back
 	badRequest := func() { w.WriteHeader(http.StatusBadRequest) }
-	// Get key and format
-	keyString := r.FormValue("key")
-	format := r.FormValue("format")
-	if keyString == "" || format == "" {
-		badRequest()
-		return
-	}
-
 	// Check API key
-	key, err := database.GetAPIKey(keyString)
-	if err != nil {
+	auth := requestAuth(r)
+	if auth == nil {
 		badRequest()
-		fmt.Fprintln(w, "Key not found")
 		return
 	}
-	if !key.Enabled {
-		w.WriteHeader(http.StatusForbidden)
-		fmt.Fprintln(w, "Key disabled")
+	key := auth.Key
+	if !auth.Signed {
+		// Deprecated: only the public key is sent
+		if !apiSettings.AllowUnsignedSubmit {
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprintln(w, "Signature required")
+			return
+		}
+		w.Header().Add("Warning", `299 - "Unsigned submissions are deprecated, please sign your requests"`)
+	}
+	// Get format
+	format := r.FormValue("format")
+	if format == "" {
+		badRequest()
 		return
 	}
 	// Metrics
-	if _, ok := keyMetrics[key.PublicKey]; !ok {
-		keyMetrics[key.PublicKey] = newAPIKeyMetrics(key)
+	metrics := getKeyMetrics(key)
+	if !auth.Signed {
+		metrics.UnsignedCounter.Incr(1)
 	}
-	// Process request
-	object, err := objectFromWebhook(format, r)
-	if err != nil {
-		keyMetrics[key.PublicKey].InvalidCounter.Incr(1)
+	// Split request into messages
+	messages, batch, err := splitWebhookBody(http.MaxBytesReader(w, r.Body, maxSubmitBodySize))
+	if err != nil || len(messages) > maxSubmitBatchSize {
+		metrics.InvalidCounter.Incr(1)
 		badRequest()
 		return
 	}
-	// Add source information
-	object.Source = key.PublicKey
-	// Time validation
-	err = validateMapObject(object, key)
-	if err != nil {
-		if err == opm.ErrPokemonExpired {
-			keyMetrics[key.PublicKey].ExpiredCounter.Incr(1)
-			badRequest()
-			return
+	// Process messages
+	results := make([]submitResult, len(messages))
+	objects := make([]opm.MapObject, 0, len(messages))
+	for i, m := range messages {
+		object, err := submitObject(format, m, key, metrics)
+		reputation.Submitted(key, object, err)
+		if err != nil {
+			results[i] = submitResult{Error: err.Error()}
+			continue
 		}
-		if err == opm.ErrPokemonFuture {
-			keyMetrics[key.PublicKey].InvalidCounter.Incr(1)
+		results[i] = submitResult{Ok: true, ID: object.ID}
+		objects = append(objects, object)
+	}
+	// Add to database (quarantined keys are only checked)
+	if !key.Quarantined {
+		database.AddMapObjects(objects)
+		publishMapObjects(objects)
+	}
+	// Write response
+	if !batch {
+		if !results[0].Ok {
 			badRequest()
 			return
 		}
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintln(w, "<3")
+		return
 	}
-	// Add to database
-	keyMetrics[key.PublicKey].PokemonCounter.Incr(1)
-	log.Printf("Adding Pokemon %d from %s (%f,%f)\n", object.PokemonID, key.Name, object.Lat, object.Lng)
-	database.AddMapObject(object)
-	// Write response
-	w.WriteHeader(http.StatusOK)
-	fmt.Fprintln(w, "<3")
+	response := submitResponse{Ok: len(objects) > 0, Accepted: len(objects), Rejected: len(messages) - len(objects), Results: results}
+	w.Header().Add("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// submitObject parses and validates a single submitted message and updates the metrics for the key
+func submitObject(format string, message []byte, key opm.APIKey, metrics APIKeyMetrics) (opm.MapObject, error) {
+	object, err := objectFromWebhook(format, message)
+	if err != nil {
+		metrics.InvalidCounter.Incr(1)
+		return object, err
+	}
+	// Add source information
+	object.Source = key.PublicKey
+	// Validation
+	err = validateMapObject(object, key)
+	if err == opm.ErrPokemonExpired {
+		metrics.ExpiredCounter.Incr(1)
+		return object, err
+	}
+	if err == opm.ErrOutOfRegion {
+		metrics.OutOfRegionCounter.Incr(1)
+		return object, err
+	}
+	if err != nil {
+		metrics.InvalidCounter.Incr(1)
+		return object, err
+	}
+	if object.Type == opm.POKEMON {
+		metrics.PokemonCounter.Incr(1)
+		log.Printf("Adding Pokemon %d from %s (%f,%f)\n", object.PokemonID, key.Name, object.Lat, object.Lng)
+	}
+	return object, nil
+}
+
+// tokenHandler issues a token for the token verifier
+func tokenHandler(w http.ResponseWriter, r *http.Request) {
+	if opmSettings.Secret == "" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	issuer := util.TokenVerifier{
+		Secret:   opmSettings.Secret,
+		Lifetime: time.Duration(apiSettings.TokenLifetime) * time.Second,
+		ClientIP: clientIP,
+	}
+	token, expiry := issuer.Issue(r)
+	w.Header().Add("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"token": token, "expiry": expiry})
+}
+
+// challengeHandler issues a challenge for the proof-of-work verifier
+func challengeHandler(w http.ResponseWriter, r *http.Request) {
+	if opmSettings.Secret == "" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	challenge, expiry := util.NewProofOfWorkVerifier(opmSettings.Secret, apiSettings.PowDifficulty).Challenge()
+	w.Header().Add("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"challenge": challenge, "expiry": expiry, "difficulty": apiSettings.PowDifficulty})
 }
 
 func cacheHandler(w http.ResponseWriter, r *http.Request) {
 	var objects []opm.MapObject
 	// Check method
 	if r.Method != "POST" {
-		writeCacheResponse(w, false, opm.ErrWrongMethod.Error(), objects)
+		writeCacheResponse(w, r, false, opm.ErrWrongMethod.Error(), objects)
 		return
 	}
 	// Get Latitude and Longitude
 	lat, err := strconv.ParseFloat(r.FormValue("lat"), 64)
 	if err != nil {
-		writeCacheResponse(w, false, "Wrong format", objects)
+		writeCacheResponse(w, r, false, "Wrong format", objects)
 		return
 	}
 	lng, err := strconv.ParseFloat(r.FormValue("lng"), 64)
 	if err != nil {
-		writeCacheResponse(w, false, "Wrong format", objects)
+		writeCacheResponse(w, r, false, "Wrong format", objects)
 		return
 	}
 	// Pokemon/Gym/Pokestop filter
-	var filter []int
+	var filter opm.MapObjectFilter
 	if r.FormValue("p") != "" {
-		filter = append(filter, opm.POKEMON)
+		filter.Types = append(filter.Types, opm.POKEMON)
 	}
 	if r.FormValue("s") != "" {
-		filter = append(filter, opm.POKESTOP)
+		filter.Types = append(filter.Types, opm.POKESTOP)
 	}
 	if r.FormValue("g") != "" {
-		filter = append(filter, opm.GYM)
+		filter.Types = append(filter.Types, opm.GYM)
 	}
 	// If no filter is set -> show everything
-	if len(filter) == 0 {
-		filter = []int{opm.POKEMON, opm.POKESTOP, opm.GYM}
+	if len(filter.Types) == 0 {
+		filter.Types = []int{opm.POKEMON, opm.POKESTOP, opm.GYM}
+	}
+	// Detailed filters
+	err = parseCacheFilter(r, &filter)
+	if err != nil {
+		writeCacheResponse(w, r, false, "Wrong format", objects)
+		return
 	}
 	// Get objects from db
-	objects, err = database.GetMapObjects(lat, lng, filter, opmSettings.CacheRadius)
+	if spatial != nil {
+		objects, err = spatial.GetMapObjects(lat, lng, filter)
+	} else {
+		objects, err = database.GetMapObjects(lat, lng, filter)
+	}
 	if err != nil {
-		writeCacheResponse(w, false, "Failed to get MapObjects from DB", objects)
+		writeCacheResponse(w, r, false, "Failed to get MapObjects from DB", objects)
 		log.Println(err)
 		return
 	}
-	writeCacheResponse(w, true, "", objects)
+	writeCacheResponse(w, r, true, "", objects)
 }
 
-func addBlacklist(w http.ResponseWriter, r *http.Request) {
-	if r.FormValue("secret") != opmSettings.Secret {
+// parseCacheFilter reads the optional filters of a cache request:
+// ids/exclude (Pokemon IDs), mintime (seconds left), teams, lured, radius (capped by CacheRadius), limit and sort (distance, expiry)
+func parseCacheFilter(r *http.Request, filter *opm.MapObjectFilter) error {
+	var err error
+	if filter.PokemonIDs, err = parseIntList(r.FormValue("ids")); err != nil {
+		return err
+	}
+	if filter.ExcludePokemonIDs, err = parseIntList(r.FormValue("exclude")); err != nil {
+		return err
+	}
+	if filter.Teams, err = parseIntList(r.FormValue("teams")); err != nil {
+		return err
+	}
+	if v := r.FormValue("mintime"); v != "" {
+		if filter.MinTimeLeft, err = strconv.ParseInt(v, 10, 64); err != nil || filter.MinTimeLeft < 0 {
+			return opm.ErrInvalidFilter
+		}
+	}
+	filter.LuredOnly = r.FormValue("lured") != ""
+	// Radius
+	filter.Radius = opmSettings.CacheRadius
+	if v := r.FormValue("radius"); v != "" {
+		radius, err := strconv.Atoi(v)
+		if err != nil || radius <= 0 {
+			return opm.ErrInvalidFilter
+		}
+		if radius < filter.Radius {
+			filter.Radius = radius
+		}
+	}
+	if v := r.FormValue("limit"); v != "" {
+		if filter.Limit, err = strconv.Atoi(v); err != nil || filter.Limit < 0 {
+			return opm.ErrInvalidFilter
+		}
+	}
+	switch r.FormValue("sort") {
+	case "", opm.SortDistance:
+		filter.Sort = opm.SortDistance
+	case opm.SortExpiry:
+		filter.Sort = opm.SortExpiry
+	default:
+		return opm.ErrInvalidFilter
+	}
+	return nil
+}
+
+// parseIntList parses a comma separated list of numbers
+func parseIntList(s string) ([]int, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var list []int
+	for _, v := range strings.Split(s, ",") {
+		i, err := strconv.Atoi(strings.TrimSpace(v))
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, i)
+	}
+	return list, nil
+}
+
+// blacklistHandler manages the blacklist.
+// GET lists all entries, POST adds an entry (addr, reason, expires, allow) and DELETE removes an entry (addr).
+// Requests need the secret or a signature of a key with the admin scope.
+func blacklistHandler(w http.ResponseWriter, r *http.Request) {
+	if !isAdmin(r) {
 		w.WriteHeader(http.StatusForbidden)
 		return
 	}
-	if r.FormValue("addr") != "" {
-		blacklist[r.FormValue("addr")] = true
-		w.WriteHeader(http.StatusOK)
-		fmt.Fprintln(w, r.FormValue("addr"))
+	switch r.Method {
+	case "GET":
+		w.Header().Add("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(blacklist.Entries())
+		return
+	case "POST":
+		n, err := util.ParseCIDR(r.FormValue("addr"))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintln(w, err)
+			return
+		}
+		entry := opm.BlacklistEntry{
+			CIDR:   n.String(),
+			Allow:  r.FormValue("allow") == "true",
+			Reason: r.FormValue("reason"),
+			Added:  time.Now().Unix(),
+		}
+		if r.FormValue("expires") != "" {
+			d, err := time.ParseDuration(r.FormValue("expires"))
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprintln(w, err)
+				return
+			}
+			entry.Expiry = time.Now().Add(d).Unix()
+		}
+		err = database.AddBlacklistEntry(entry)
+		if err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	case "DELETE":
+		n, err := util.ParseCIDR(r.FormValue("addr"))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintln(w, err)
+			return
+		}
+		err = database.RemoveBlacklistEntry(n.String())
+		if err == mgo.ErrNotFound {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprintln(w, err)
+			return
+		} else if err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	// Apply changes right away
+	err := blacklist.Reload()
+	if err != nil {
+		log.Println(err)
 	}
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintln(w, r.FormValue("addr"))
 }
 
-func writeCacheResponse(w http.ResponseWriter, ok bool, e string, response []opm.MapObject) {
+func writeCacheResponse(w http.ResponseWriter, r *http.Request, ok bool, e string, response []opm.MapObject) {
 	if !ok {
 		apiMetrics.CacheRequestFailsPerMinute.Incr(1)
 	}
-	writeAPIResopnse(w, ok, e, response)
+	writeAPIResopnse(w, r, opm.APIResponse{Ok: ok, Error: e, MapObjects: response})
 }
 
-func writeAPIResopnse(w http.ResponseWriter, ok bool, e string, response []opm.MapObject) {
-	w.Header().Add("Content-Type", "application/json")
+// writeAPIResopnse writes the response in the format and compression the client asked for
+func writeAPIResopnse(w http.ResponseWriter, req *http.Request, r opm.APIResponse) {
+	format := responseFormat(req)
+	w.Header().Add("Content-Type", formatContentTypes[format])
 
+	e := r.Error
 	if e != "" && e != opm.ErrScanTimeout.Error() && e != opm.ErrBusy.Error() && e != "Wrong format" && e != "Wrong method" && e != "Failed to get MapObjects from DB" {
-		e = "Scan failed"
+		r.Error = "Scan failed"
 	}
 
-	r := opm.APIResponse{Ok: ok, Error: e, MapObjects: response}
-	err := json.NewEncoder(w).Encode(r)
+	cw := compressedWriter(w, req)
+	err := encodeAPIResponse(cw, format, r)
 	if err != nil {
 		log.Println(err)
 	}
+	cw.Close()
 }
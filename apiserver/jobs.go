@@ -0,0 +1,312 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pogointel/opm/opm"
+	"github.com/pogointel/opm/util"
+)
+
+// scanJobStep is the distance between the locations of a scan job in meters
+const scanJobStep = 120
+
+// scanJobMaxWait is how long a job waits for busy scanners before a location counts as failed
+const scanJobMaxWait = 10 * time.Minute
+
+// scanJobBackoff is the longest pause between two tries of a location
+const scanJobBackoff = time.Minute
+
+// scanJobQueue runs asynchronous scan jobs. Jobs are stored in the db, so results survive restarts.
+type scanJobQueue struct {
+	lock      sync.Mutex
+	cond      *sync.Cond
+	queue     []*opm.ScanJob
+	maxSize   int
+	perClient int
+	active    map[string]int // Queued and running jobs per client
+}
+
+func newScanJobQueue(s settings) *scanJobQueue {
+	q := &scanJobQueue{maxSize: s.ScanJobQueueSize, perClient: s.ScanJobPerClient, active: make(map[string]int)}
+	q.cond = sync.NewCond(&q.lock)
+	return q
+}
+
+// Load queues the jobs that were not finished before a restart
+func (q *scanJobQueue) Load() error {
+	jobs, err := database.GetUnfinishedScanJobs()
+	if err != nil {
+		return err
+	}
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	for i := range jobs {
+		jobs[i].Status = opm.ScanJobQueued
+		q.queue = append(q.queue, &jobs[i])
+		q.active[jobs[i].Client]++
+	}
+	q.cond.Broadcast()
+	return nil
+}
+
+// check returns an error, if the queue is full or the client has too many jobs already. The lock must be held.
+func (q *scanJobQueue) check(client string) error {
+	if len(q.queue) >= q.maxSize {
+		return opm.ErrBusy
+	}
+	if q.perClient > 0 && q.active[client] >= q.perClient {
+		return opm.ErrTooManyJobs
+	}
+	return nil
+}
+
+// Submit stores and queues a new job. The job is only charged, if it fits into the queue.
+func (q *scanJobQueue) Submit(job *opm.ScanJob, charge func() error) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if err := q.check(job.Client); err != nil {
+		return err
+	}
+	if err := charge(); err != nil {
+		return err
+	}
+	err := database.AddScanJob(*job)
+	if err != nil {
+		return err
+	}
+	q.queue = append(q.queue, job)
+	q.active[job.Client]++
+	q.cond.Signal()
+	return nil
+}
+
+// finished removes a job from the jobs of its client
+func (q *scanJobQueue) finished(job *opm.ScanJob) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.active[job.Client]--
+	if q.active[job.Client] <= 0 {
+		delete(q.active, job.Client)
+	}
+}
+
+// Position returns the position of a job in the queue (starting at 1) or 0, if it isn't queued
+func (q *scanJobQueue) Position(id string) int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	for i, j := range q.queue {
+		if j.ID == id {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+func (q *scanJobQueue) next() *opm.ScanJob {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	for len(q.queue) == 0 {
+		q.cond.Wait()
+	}
+	job := q.queue[0]
+	q.queue = q.queue[1:]
+	return job
+}
+
+// Run starts the workers and removes old jobs periodically
+func (q *scanJobQueue) Run(workers int, retention time.Duration) {
+	for i := 0; i < workers; i++ {
+		go func() {
+			for {
+				q.process(q.next())
+			}
+		}()
+	}
+	for {
+		_, err := database.RemoveOldScanJobs(time.Now().Add(-retention).Unix())
+		if err != nil {
+			log.Println(err)
+		}
+		time.Sleep(time.Minute)
+	}
+}
+
+// process scans all locations of a job and stores the results after every location
+func (q *scanJobQueue) process(job *opm.ScanJob) {
+	job.Status = opm.ScanJobRunning
+	job.Started = time.Now().Unix()
+	job.Done = 0
+	q.save(job)
+	seen := make(map[string]bool)
+	for _, o := range job.MapObjects {
+		seen[o.ID] = true
+	}
+	rings := int(math.Ceil(float64(job.Radius) / scanJobStep))
+	points := util.HexGrid(job.Lat, job.Lng, rings, scanJobStep)
+	failed := 0
+	for _, p := range points {
+		response, err := q.scan(p.Lat, p.Lng, job.Client)
+		if err != nil || !response.Ok {
+			if err != nil {
+				log.Println(err)
+				response.Error = "Scan failed"
+			}
+			job.Error = response.Error
+			failed++
+		} else {
+			for _, o := range response.MapObjects {
+				if !seen[o.ID] {
+					seen[o.ID] = true
+					job.MapObjects = append(job.MapObjects, o)
+				}
+			}
+			if response.FreshAsOf == 0 {
+				publishMapObjects(response.MapObjects)
+				reputation.Scanned(p.Lat, p.Lng, response.MapObjects)
+			}
+		}
+		job.Done++
+		q.save(job)
+	}
+	job.Status = opm.ScanJobDone
+	if failed == len(points) {
+		job.Status = opm.ScanJobFailed
+	}
+	job.Finished = time.Now().Unix()
+	q.save(job)
+	q.finished(job)
+}
+
+// scan scans a location of a job. Busy scanners and full scan queues are waited out up to scanJobMaxWait.
+func (q *scanJobQueue) scan(lat, lng float64, client string) (opm.APIResponse, error) {
+	deadline := time.Now().Add(scanJobMaxWait)
+	backoff := 5 * time.Second
+	for {
+		response, err := scanners.Scan(lat, lng, client)
+		busy := err == opm.ErrScanTimeout || (err == nil && !response.Ok &&
+			(response.Error == opm.ErrBusy.Error() || response.Error == opm.ErrScanTimeout.Error()))
+		if !busy {
+			return response, err
+		}
+		// Come back when the scanner expects to have a trainer
+		wait := backoff
+		if response.EstimatedWait > 0 {
+			wait = time.Duration(response.EstimatedWait) * time.Second
+		}
+		if wait > scanJobBackoff {
+			wait = scanJobBackoff
+		}
+		if time.Now().Add(wait).After(deadline) {
+			return response, err
+		}
+		time.Sleep(wait)
+		backoff *= 2
+	}
+}
+
+func (q *scanJobQueue) save(job *opm.ScanJob) {
+	err := database.UpdateScanJob(*job)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// scanJobResponse is sent for scan jobs
+type scanJobResponse struct {
+	opm.ScanJob
+	Position int `json:"position,omitempty"`
+}
+
+// asyncScans handles POST /scan?async=1 as scan job. Everything else is passed on to inner.
+func asyncScans(inner func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("async") == "" {
+			inner(w, r)
+			return
+		}
+		createScanJobHandler(w, r)
+	}
+}
+
+// createScanJobHandler queues a scan job for lat/lng and an optional radius
+func createScanJobHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	lat, latErr := strconv.ParseFloat(r.FormValue("lat"), 64)
+	lng, lngErr := strconv.ParseFloat(r.FormValue("lng"), 64)
+	radius, radiusErr := 0, error(nil)
+	if r.FormValue("radius") != "" {
+		radius, radiusErr = strconv.Atoi(r.FormValue("radius"))
+	}
+	if latErr != nil || lngErr != nil || radiusErr != nil || radius < 0 || radius > apiSettings.ScanJobMaxRadius {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	id, err := opm.GenerateKey(8)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	job := &opm.ScanJob{
+		ID:         id,
+		Status:     opm.ScanJobQueued,
+		Lat:        lat,
+		Lng:        lng,
+		Radius:     radius,
+		MapObjects: []opm.MapObject{},
+		Client:     clientIP(r),
+		Created:    time.Now().Unix(),
+	}
+	job.Points = len(util.HexGrid(lat, lng, int(math.Ceil(float64(radius)/scanJobStep)), scanJobStep))
+	// The request was charged for one scan already, the other locations are charged when the job is queued
+	created := *job
+	err = scanJobs.Submit(job, func() error {
+		_, err := chargeRequest(w, r, job.Points-1)
+		return err
+	})
+	switch err {
+	case nil:
+	case opm.ErrBusy:
+		writeScanJobError(w, http.StatusServiceUnavailable, err)
+		return
+	case opm.ErrTooManyJobs, opm.ErrRateLimited, opm.ErrQuotaExceeded:
+		writeScanJobError(w, http.StatusTooManyRequests, err)
+		return
+	default:
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Location", "/scan/"+job.ID)
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	// The job belongs to a worker now, only the copy from before is written
+	json.NewEncoder(w).Encode(scanJobResponse{created, scanJobs.Position(created.ID)})
+}
+
+func writeScanJobError(w http.ResponseWriter, status int, err error) {
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(opm.APIResponse{Error: err.Error()})
+}
+
+// scanJobHandler returns the status and the results so far of a scan job (GET /scan/{id})
+func scanJobHandler(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/scan/")
+	job, err := database.GetScanJob(id)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	writeJSON(w, scanJobResponse{job, scanJobs.Position(id)})
+}
@@ -0,0 +1,527 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/mgo.v2"
+
+	"github.com/pogointel/opm/opm"
+	"github.com/pogointel/opm/util"
+)
+
+// usageFlushInterval is the time between writes of the usage counters to the db
+const usageFlushInterval = 30 * time.Second
+
+type contextKey int
+
+const authContextKey contextKey = 0
+
+// authenticatedKey is the API key of a request
+type authenticatedKey struct {
+	Key    opm.APIKey
+	Signed bool // Request was signed with the private key
+}
+
+// routeScope returns the scope a key needs for a route
+func routeScope(path string) string {
+	switch {
+	case path == "/submit":
+		return opm.ScopeSubmit
+	case path == "/cache":
+		return opm.ScopeCacheRead
+	case path == "/scan":
+		return opm.ScopeScan
+	case strings.HasPrefix(path, "/admin/"):
+		return opm.ScopeAdmin
+	}
+	return ""
+}
+
+// requestKey returns the public key of a request without parsing the body
+func requestKey(r *http.Request) string {
+	if k := r.Header.Get(util.KeyHeader); k != "" {
+		return k
+	}
+	return r.URL.Query().Get("key")
+}
+
+// authenticate returns the API key of a request. Requests without a key return nil.
+func authenticate(r *http.Request) (*authenticatedKey, error) {
+	// Signed with the private key
+	if submitVerifier.Signed(r) {
+		key, err := submitVerifier.VerifyKey(r)
+		if err != nil {
+			return nil, err
+		}
+		return &authenticatedKey{Key: key, Signed: true}, nil
+	}
+	// Only the public key
+	public := requestKey(r)
+	if public == "" {
+		return nil, nil
+	}
+	key, err := database.GetAPIKey(public)
+	if err != nil {
+		return nil, opm.ErrKeyNotFound
+	}
+	if !key.Enabled {
+		return nil, opm.ErrKeyDisabled
+	}
+	return &authenticatedKey{Key: key}, nil
+}
+
+// checkKey authenticates the API key of a request and enforces its scopes and quotas.
+// The key is added to the context of the returned request. Requests without a key or signature get the anonymous limits.
+func checkKey(r *http.Request) (*http.Request, int, error) {
+	auth, err := authenticate(r)
+	if err != nil {
+		return r, http.StatusForbidden, err
+	}
+	scope := routeScope(r.URL.Path)
+	if auth == nil {
+		status, err := checkAnonymous(r, scope)
+		return r, status, err
+	}
+	// Anyone can know the public key, so only signed requests get the scopes and quotas of the key.
+	// Unsigned submissions are checked by the submit handler (AllowUnsignedSubmit).
+	if !auth.Signed && scope != opm.ScopeSubmit {
+		if scope == opm.ScopeAdmin {
+			return r, http.StatusForbidden, util.ErrVerificationMissing
+		}
+		status, err := checkAnonymous(r, scope)
+		return r, status, err
+	}
+	// Scopes
+	if scope != "" && !auth.Key.HasScope(scope) {
+		return r, http.StatusForbidden, opm.ErrMissingScope
+	}
+	// Quotas
+	if !usage.Use(auth.Key, 1) {
+		return r, http.StatusTooManyRequests, opm.ErrQuotaExceeded
+	}
+	return r.WithContext(context.WithValue(r.Context(), authContextKey, auth)), http.StatusOK, nil
+}
+
+// checkAnonymous enforces the scopes and the daily quota per client IP of requests without an API key.
+// Admin routes check the secret and /submit needs a key anyway, so only cache reads and scans are limited.
+func checkAnonymous(r *http.Request, scope string) (int, error) {
+	if scope != opm.ScopeCacheRead && scope != opm.ScopeScan {
+		return http.StatusOK, nil
+	}
+	anonymous := anonymousKey(r)
+	if !anonymous.HasScope(scope) {
+		return http.StatusForbidden, opm.ErrKeyRequired
+	}
+	if anonymous.DailyQuota > 0 && !anonymousUsage.Use(anonymous, 1) {
+		return http.StatusTooManyRequests, opm.ErrQuotaExceeded
+	}
+	return http.StatusOK, nil
+}
+
+// anonymousKey returns the limits of a request without an API key
+func anonymousKey(r *http.Request) opm.APIKey {
+	return opm.APIKey{PublicKey: clientIP(r), Scopes: apiSettings.AnonymousScopes, DailyQuota: apiSettings.AnonymousDailyQuota}
+}
+
+// chargeRequest charges n more units of the rate limits and quotas of a request that was checked already
+// (e.g. for the locations of a scan job)
+func chargeRequest(w http.ResponseWriter, r *http.Request, n int) (int, error) {
+	if n <= 0 {
+		return http.StatusOK, nil
+	}
+	auth := requestAuth(r)
+	public := ""
+	if auth != nil {
+		public = auth.Key.PublicKey
+	}
+	if !rateLimiters.AllowN(w, r, clientIP(r), public, n) {
+		apiMetrics.RateLimitedRequestsPerMinute.Incr(1)
+		return http.StatusTooManyRequests, opm.ErrRateLimited
+	}
+	var allowed bool
+	if auth != nil {
+		allowed = usage.Use(auth.Key, n)
+	} else {
+		anonymous := anonymousKey(r)
+		allowed = anonymous.DailyQuota == 0 || anonymousUsage.Use(anonymous, n)
+	}
+	if !allowed {
+		return http.StatusTooManyRequests, opm.ErrQuotaExceeded
+	}
+	return http.StatusOK, nil
+}
+
+// requestAuth returns the API key that was authenticated for the request, if any
+func requestAuth(r *http.Request) *authenticatedKey {
+	auth, _ := r.Context().Value(authContextKey).(*authenticatedKey)
+	return auth
+}
+
+// isAdmin checks if the request has the secret or was signed by a key with the admin scope
+func isAdmin(r *http.Request) bool {
+	if opmSettings.Secret != "" && r.FormValue("secret") == opmSettings.Secret {
+		return true
+	}
+	auth := requestAuth(r)
+	return auth != nil && auth.Signed && auth.Key.HasScope(opm.ScopeAdmin)
+}
+
+// keyInfo is the public part of an API key that is shown by the key endpoints
+type keyInfo struct {
+	PublicKey      string   `json:"publickey"`
+	Name           string   `json:"name"`
+	URL            string   `json:"url,omitempty"`
+	Verified       bool     `json:"verified"`
+	Enabled        bool     `json:"enabled"`
+	Quarantined    bool     `json:"quarantined"`
+	DisabledReason string   `json:"disabled_reason,omitempty"`
+	Scopes         []string `json:"scopes,omitempty"`
+	DailyQuota     int      `json:"daily_quota,omitempty"`
+	MonthlyQuota   int      `json:"monthly_quota,omitempty"`
+	Reputation     float64  `json:"reputation"`
+}
+
+func newKeyInfo(k opm.APIKey) keyInfo {
+	return keyInfo{
+		PublicKey:      k.PublicKey,
+		Name:           k.Name,
+		URL:            k.URL,
+		Verified:       k.Verified,
+		Enabled:        k.Enabled,
+		Quarantined:    k.Quarantined,
+		DisabledReason: k.DisabledReason,
+		Scopes:         k.Scopes,
+		DailyQuota:     k.DailyQuota,
+		MonthlyQuota:   k.MonthlyQuota,
+		Reputation:     reputationScore(k.Reputation, apiSettings.ReputationMinSamples),
+	}
+}
+
+// createdKey is returned when a key is created or rotated. The private key is never shown again.
+type createdKey struct {
+	keyInfo
+	PrivateKey string `json:"privatekey"`
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Add("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// checkKeyForm validates the name and webhook URL of a key
+func checkKeyForm(name, webhookURL string) error {
+	if name == "" || len(name) > 64 {
+		return fmt.Errorf("Invalid name")
+	}
+	if webhookURL != "" {
+		u, err := url.Parse(webhookURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("Invalid URL")
+		}
+	}
+	return nil
+}
+
+// rotateKey replaces the private key of k and returns the new one
+func rotateKey(k opm.APIKey) (opm.APIKey, string, error) {
+	private, err := k.Rotate(opmSettings.Secret)
+	if err != nil {
+		return k, "", err
+	}
+	return k, private, database.UpdateAPIKey(k)
+}
+
+// keysHandler manages API keys. The target key is passed as publickey.
+// GET lists all keys, POST creates a key (name, url, scopes), PUT updates a key (name, url, enabled) and DELETE removes a key.
+// Requests need the secret or a signature of a key with the admin scope.
+func keysHandler(w http.ResponseWriter, r *http.Request) {
+	if !isAdmin(r) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	switch r.Method {
+	case "GET":
+		keys, err := database.GetAPIKeys()
+		if err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		infos := make([]keyInfo, len(keys))
+		for i, k := range keys {
+			infos[i] = newKeyInfo(k)
+		}
+		writeJSON(w, infos)
+	case "POST":
+		name, webhookURL := r.FormValue("name"), r.FormValue("url")
+		if err := checkKeyForm(name, webhookURL); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintln(w, err)
+			return
+		}
+		key, private, err := opm.NewAPIKey(name, webhookURL, opmSettings.Secret)
+		if err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if r.FormValue("scopes") != "" {
+			for _, scope := range strings.Split(r.FormValue("scopes"), ",") {
+				if !opm.IsScope(scope) {
+					w.WriteHeader(http.StatusBadRequest)
+					fmt.Fprintf(w, "Unknown scope: %s\n", scope)
+					return
+				}
+				key.Scopes = append(key.Scopes, scope)
+			}
+		}
+		err = database.AddAPIKey(key)
+		if err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, createdKey{newKeyInfo(key), private})
+	case "PUT":
+		key, err := database.GetAPIKey(r.FormValue("publickey"))
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if r.FormValue("name") != "" {
+			key.Name = r.FormValue("name")
+		}
+		if r.FormValue("url") != "" {
+			key.URL = r.FormValue("url")
+		}
+		if err := checkKeyForm(key.Name, key.URL); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintln(w, err)
+			return
+		}
+		switch r.FormValue("enabled") {
+		case "true":
+			if !key.Enabled || key.Quarantined {
+				key.Reenable()
+			}
+		case "false":
+			key.Enabled = false
+			key.DisabledReason = "Disabled by an admin"
+		}
+		err = database.UpdateAPIKey(key)
+		if err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, newKeyInfo(key))
+	case "DELETE":
+		err := database.DeleteAPIKey(r.FormValue("publickey"))
+		if err == mgo.ErrNotFound {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		} else if err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// rotateKeyHandler replaces the private key of a key (publickey), the public key stays the same.
+// Admins can rotate any key, everyone else can rotate the key that signed the request.
+func rotateKeyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	var key opm.APIKey
+	var err error
+	auth := requestAuth(r)
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/admin/") && isAdmin(r):
+		key, err = database.GetAPIKey(r.FormValue("publickey"))
+		if err != nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+	case auth != nil && auth.Signed:
+		key = auth.Key
+	default:
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	key, private, err := rotateKey(key)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Rotated private key of %s", key.Name)
+	writeJSON(w, createdKey{newKeyInfo(key), private})
+}
+
+// registerKeyHandler lets anyone create a key (name, url), if registration is allowed.
+// Registered keys wait for an admin to enable them, unless EnableRegisteredKeys is set.
+func registerKeyHandler(w http.ResponseWriter, r *http.Request) {
+	if !apiSettings.AllowKeyRegistration {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	name, webhookURL := r.FormValue("name"), r.FormValue("url")
+	if err := checkKeyForm(name, webhookURL); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(w, err)
+		return
+	}
+	key, private, err := opm.NewAPIKey(name, webhookURL, opmSettings.Secret)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if !apiSettings.EnableRegisteredKeys {
+		key.Enabled = false
+		key.DisabledReason = "Waiting for approval"
+	}
+	err = database.AddAPIKey(key)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Registered key %s for %s", key.PublicKey, key.Name)
+	writeJSON(w, createdKey{newKeyInfo(key), private})
+}
+
+type usageCounter struct {
+	count   int
+	pending int
+}
+
+// usageTracker counts requests per key and period and persists the counters in the db
+type usageTracker struct {
+	lock     sync.Mutex
+	counters map[string]map[string]*usageCounter // public key -> period -> counter
+	persist  bool                                // Counters are only kept in memory otherwise (e.g. per client IP)
+}
+
+func newUsageTracker(persist bool) *usageTracker {
+	return &usageTracker{counters: make(map[string]map[string]*usageCounter), persist: persist}
+}
+
+// counter returns the counter of a key in a period. New counters start at count. The lock must be held.
+func (u *usageTracker) counter(public, period string, count int) *usageCounter {
+	periods, ok := u.counters[public]
+	if !ok {
+		periods = make(map[string]*usageCounter)
+		u.counters[public] = periods
+	}
+	c, ok := periods[period]
+	if !ok {
+		c = &usageCounter{count: count}
+		periods[period] = c
+	}
+	return c
+}
+
+// stored loads the usage of a key in a period from the db, unless its counter is in memory already.
+// The db is queried without holding the lock.
+func (u *usageTracker) stored(public, period string) int {
+	if !u.persist {
+		return 0
+	}
+	u.lock.Lock()
+	_, ok := u.counters[public][period]
+	u.lock.Unlock()
+	if ok {
+		return 0
+	}
+	count, err := database.GetUsage(public, period)
+	if err != nil {
+		log.Println(err)
+	}
+	return count
+}
+
+// Use counts n requests for the key. It returns false, if they would exceed a quota of the key.
+func (u *usageTracker) Use(key opm.APIKey, n int) bool {
+	day, month := opm.UsagePeriods(time.Now())
+	storedDay := u.stored(key.PublicKey, day)
+	storedMonth := u.stored(key.PublicKey, month)
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	d := u.counter(key.PublicKey, day, storedDay)
+	m := u.counter(key.PublicKey, month, storedMonth)
+	if (key.DailyQuota > 0 && d.count+n > key.DailyQuota) || (key.MonthlyQuota > 0 && m.count+n > key.MonthlyQuota) {
+		return false
+	}
+	d.count += n
+	d.pending += n
+	m.count += n
+	m.pending += n
+	return true
+}
+
+// Run writes the counters to the db periodically
+func (u *usageTracker) Run() {
+	for {
+		time.Sleep(usageFlushInterval)
+		u.flush()
+	}
+}
+
+func (u *usageTracker) flush() {
+	day, month := opm.UsagePeriods(time.Now())
+	// Take the pending counts, the db is written without holding the lock
+	pending := make(map[string]map[string]int)
+	u.lock.Lock()
+	for public, periods := range u.counters {
+		for period, c := range periods {
+			if c.pending > 0 && u.persist {
+				if pending[public] == nil {
+					pending[public] = make(map[string]int)
+				}
+				pending[public][period] = c.pending
+				c.pending = 0
+			} else if period != day && period != month {
+				// Forget old periods
+				delete(periods, period)
+			}
+		}
+		if len(periods) == 0 {
+			delete(u.counters, public)
+		}
+	}
+	u.lock.Unlock()
+	for public, periods := range pending {
+		for period, n := range periods {
+			err := database.IncrementUsage(public, period, n)
+			if err != nil {
+				log.Println(err)
+				// Try again next time
+				u.lock.Lock()
+				u.counter(public, period, 0).pending += n
+				u.lock.Unlock()
+			}
+		}
+	}
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/kellydunn/golang-geo"
+	"github.com/pogointel/opm/opm"
+)
+
+const (
+	// Time allowed to read the next pong message from the client.
+	livePongWait = 30 * time.Second
+	// Send pings to the client with this period. Must be less than livePongWait.
+	livePingPeriod = (livePongWait * 7) / 10
+	// Time allowed to write a message to the client.
+	liveWriteWait = 10 * time.Second
+	// Number of messages buffered per client. Clients that fall further behind are disconnected.
+	liveSendBuffer = 64
+	// Interval for checking for despawned Pokemon
+	liveDespawnInterval = 5 * time.Second
+)
+
+var liveUpgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+	CheckOrigin: func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		return opmSettings.AllowOrigin == "*" || origin == "" || strings.HasSuffix(origin, opmSettings.AllowOrigin)
+	},
+}
+
+// liveMessage is sent to the clients of the live feed
+type liveMessage struct {
+	Event      string          `json:"event"`
+	MapObjects []opm.MapObject `json:"objects,omitempty"`
+	IDs        []string        `json:"ids,omitempty"`
+	Error      string          `json:"error,omitempty"`
+}
+
+// viewport is the area a live feed client is subscribed to.
+// Clients send it as json to subscribe or to change their area.
+type viewport struct {
+	SwLat float64 `json:"swLat"`
+	SwLng float64 `json:"swLng"`
+	NeLat float64 `json:"neLat"`
+	NeLng float64 `json:"neLng"`
+}
+
+func (v viewport) contains(lat, lng float64) bool {
+	return lat >= v.SwLat && lat <= v.NeLat && lng >= v.SwLng && lng <= v.NeLng
+}
+
+// size returns the length of the diagonal of the viewport in meters
+func (v viewport) size() float64 {
+	return geo.NewPoint(v.SwLat, v.SwLng).GreatCircleDistance(geo.NewPoint(v.NeLat, v.NeLng)) * 1000
+}
+
+type liveClient struct {
+	conn *websocket.Conn
+	addr string
+	send chan liveMessage
+	lock sync.RWMutex
+	view *viewport
+}
+
+func (c *liveClient) viewport() *viewport {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.view
+}
+
+// liveFeed pushes new MapObjects and despawns to websocket clients
+type liveFeed struct {
+	lock    sync.RWMutex
+	clients map[*liveClient]bool
+	perAddr map[string]int
+	pokemon map[string]opm.MapObject
+}
+
+func newLiveFeed() *liveFeed {
+	return &liveFeed{
+		clients: make(map[*liveClient]bool),
+		perAddr: make(map[string]int),
+		pokemon: make(map[string]opm.MapObject),
+	}
+}
+
+// Len returns the number of connected clients
+func (f *liveFeed) Len() int {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+	return len(f.clients)
+}
+
+// Run sends despawn notifications for expired Pokemon
+func (f *liveFeed) Run() {
+	for {
+		time.Sleep(liveDespawnInterval)
+		now := time.Now().Unix()
+		var expired []opm.MapObject
+		f.lock.Lock()
+		for id, p := range f.pokemon {
+			if p.Expiry <= now {
+				expired = append(expired, p)
+				delete(f.pokemon, id)
+			}
+		}
+		f.lock.Unlock()
+		if len(expired) > 0 {
+			f.broadcast("despawn", expired)
+		}
+	}
+}
+
+// Publish sends new MapObjects to all clients whose viewport contains them
+func (f *liveFeed) Publish(objects []opm.MapObject) {
+	f.lock.Lock()
+	for _, o := range objects {
+		if o.Type == opm.POKEMON {
+			f.pokemon[o.ID] = o
+		}
+	}
+	f.lock.Unlock()
+	f.broadcast("add", objects)
+}
+
+func (f *liveFeed) broadcast(event string, objects []opm.MapObject) {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+	for c := range f.clients {
+		v := c.viewport()
+		if v == nil {
+			continue
+		}
+		msg := liveMessage{Event: event}
+		for _, o := range objects {
+			if !v.contains(o.Lat, o.Lng) {
+				continue
+			}
+			if event == "despawn" {
+				msg.IDs = append(msg.IDs, o.ID)
+			} else {
+				msg.MapObjects = append(msg.MapObjects, o)
+			}
+		}
+		if len(msg.IDs) == 0 && len(msg.MapObjects) == 0 {
+			continue
+		}
+		select {
+		case c.send <- msg:
+		default:
+			// Client can't keep up -> disconnect it
+			apiMetrics.LiveClientsDroppedPerMinute.Incr(1)
+			go f.remove(c)
+		}
+	}
+}
+
+func (f *liveFeed) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	addr := clientIP(r)
+	// Connection limits
+	f.lock.Lock()
+	if len(f.clients) >= apiSettings.LiveMaxConnections || f.perAddr[addr] >= apiSettings.LiveMaxConnectionsPerIP {
+		f.lock.Unlock()
+		w.WriteHeader(http.StatusTooManyRequests)
+		return
+	}
+	f.perAddr[addr]++
+	f.lock.Unlock()
+	// Upgrade connection
+	conn, err := liveUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		f.lock.Lock()
+		f.release(addr)
+		f.lock.Unlock()
+		return
+	}
+	c := &liveClient{conn: conn, addr: addr, send: make(chan liveMessage, liveSendBuffer)}
+	f.lock.Lock()
+	f.clients[c] = true
+	f.lock.Unlock()
+	go f.writeHandler(c)
+	f.readHandler(c)
+}
+
+// release frees a connection slot of addr. Callers must hold the lock.
+func (f *liveFeed) release(addr string) {
+	f.perAddr[addr]--
+	if f.perAddr[addr] <= 0 {
+		delete(f.perAddr, addr)
+	}
+}
+
+// remove disconnects a client. The send channel is only closed here, with the lock held.
+func (f *liveFeed) remove(c *liveClient) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if !f.clients[c] {
+		return
+	}
+	delete(f.clients, c)
+	f.release(c.addr)
+	close(c.send)
+}
+
+// readHandler reads viewport updates from the client until it disconnects
+func (f *liveFeed) readHandler(c *liveClient) {
+	defer f.remove(c)
+	c.conn.SetReadLimit(1024)
+	c.conn.SetReadDeadline(time.Now().Add(livePongWait))
+	c.conn.SetPongHandler(func(string) error {
+		c.conn.SetReadDeadline(time.Now().Add(livePongWait))
+		return nil
+	})
+	for {
+		var v viewport
+		err := c.conn.ReadJSON(&v)
+		if err != nil {
+			return
+		}
+		if v.SwLat > v.NeLat || v.SwLng > v.NeLng || v.size() > float64(apiSettings.LiveMaxViewportSize) {
+			// The feed lock keeps remove from closing the channel in the meantime
+			f.lock.RLock()
+			if f.clients[c] {
+				select {
+				case c.send <- liveMessage{Event: "error", Error: "Invalid viewport"}:
+				default:
+				}
+			}
+			f.lock.RUnlock()
+			continue
+		}
+		c.lock.Lock()
+		c.view = &v
+		c.lock.Unlock()
+	}
+}
+
+// writeHandler sends queued messages and pings to the client
+func (f *liveFeed) writeHandler(c *liveClient) {
+	ticker := time.NewTicker(livePingPeriod)
+	defer func() {
+		ticker.Stop()
+		c.conn.Close()
+	}()
+	for {
+		select {
+		case msg, ok := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(liveWriteWait))
+			if !ok {
+				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+				return
+			}
+			if err := c.conn.WriteJSON(msg); err != nil {
+				return
+			}
+		case <-ticker.C:
+			c.conn.SetWriteDeadline(time.Now().Add(liveWriteWait))
+			if err := c.conn.WriteMessage(websocket.PingMessage, []byte{}); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// publishMapObjects passes new MapObjects on to the spatial cache, the live feed and the webhook subscribers
+func publishMapObjects(objects []opm.MapObject) {
+	if len(objects) == 0 {
+		return
+	}
+	if spatial != nil {
+		spatial.Add(objects)
+	}
+	live.Publish(objects)
+	webhooks.Publish(objects)
+}
@@ -3,18 +3,32 @@ package main
 import (
 	"expvar"
 	"log"
+	"time"
 
 	"github.com/pogointel/opm/db"
 	"github.com/pogointel/opm/opm"
+	"github.com/pogointel/opm/util"
 )
 
 var (
-	database    *db.OpenMapDb
-	opmSettings opm.Settings
-	apiSettings settings
-	keyMetrics  KeyMetrics
-	apiMetrics  APIMetrics
-	blacklist   map[string]bool
+	database       *db.OpenMapDb
+	opmSettings    opm.Settings
+	apiSettings    settings
+	keyMetrics     KeyMetrics
+	apiMetrics     *APIMetrics
+	webhooks       *webhookDispatcher
+	live           *liveFeed
+	rateLimiters   routeLimiters
+	blacklist      *util.IPList
+	ipResolver     *util.IPResolver
+	verifiers      util.RouteVerifiers
+	submitVerifier *util.SignatureVerifier
+	reputation     *reputationTracker
+	usage          *usageTracker
+	anonymousUsage *usageTracker
+	spatial        *spatialCache
+	scanners       *scannerPool
+	scanJobs       *scanJobQueue
 )
 
 func main() {
@@ -25,15 +39,88 @@ func main() {
 	if err != nil {
 		log.Println(err)
 	}
+	if err = apiSettings.check(); err != nil {
+		log.Fatalf("Invalid settings: %s", err)
+	}
 	opmSettings, err = opm.LoadSettings("")
 	// Db connections
 	database, err = db.NewOpenMapDb(opmSettings.DbName, opmSettings.DbHost, opmSettings.DbUser, opmSettings.DbPassword)
 	if err != nil {
 		log.Fatal(err)
 	}
+	// Only keep sealed hashes of private keys
+	if opmSettings.Secret == "" {
+		log.Println("Warning: no secret configured. Hashes of private keys are stored unsealed.")
+	} else {
+		count, err := database.SealPrivateKeys(opmSettings.Secret)
+		if err != nil {
+			log.Printf("Sealing private keys failed: %s", err)
+		} else if count > 0 {
+			log.Printf("Sealed %d private keys", count)
+		}
+	}
+	// Client IPs
+	ipResolver, err = util.NewIPResolver(opmSettings.TrustedProxies, opmSettings.ClientIPHeaders)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// Request verification
+	verifiers, err = util.NewRouteVerifiers(apiSettings.Verifiers, util.VerifierOptions{
+		Secret:        opmSettings.Secret,
+		TokenLifetime: time.Duration(apiSettings.TokenLifetime) * time.Second,
+		Difficulty:    apiSettings.PowDifficulty,
+		ClientIP:      clientIP,
+		GetKey:        database.GetAPIKey,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	submitVerifier = util.NewSignatureVerifier(opmSettings.Secret, database.GetAPIKey)
+	// Blacklist
+	blacklist = util.NewIPList(func() ([]opm.BlacklistEntry, error) {
+		database.RemoveExpiredBlacklistEntries()
+		return database.GetBlacklist()
+	})
+	go blacklist.Run(30 * time.Second)
+	// Quotas
+	usage = newUsageTracker(true)
+	go usage.Run()
+	anonymousUsage = newUsageTracker(false)
+	go anonymousUsage.Run()
+	// Reputation
+	reputation = newReputationTracker()
+	go reputation.Run()
+	// Spatial cache
+	if apiSettings.SpatialCacheTTL > 0 {
+		spatial = newSpatialCache(apiSettings)
+		go spatial.Run()
+		expvar.Publish("spatial_cache", spatial)
+	}
+	// Live feed
+	live = newLiveFeed()
+	go live.Run()
 	// Expvar
 	keyMetrics = make(map[string]APIKeyMetrics)
 	expvar.Publish("metrics", keyMetrics)
+	apiMetrics = NewAPIMetrics()
+	expvar.Publish("api_metrics", apiMetrics)
+	// Webhooks
+	webhooks, err = newWebhookDispatcher(apiSettings)
+	if err != nil {
+		log.Fatal(err)
+	}
+	go webhooks.Run()
+	// Scanners
+	scanners = newScannerPool(apiSettings)
+	go scanners.Run(time.Duration(apiSettings.ScannerHealthInterval) * time.Second)
+	expvar.Publish("scanners", scanners)
+	// Scan jobs
+	scanJobs = newScanJobQueue(apiSettings)
+	err = scanJobs.Load()
+	if err != nil {
+		log.Println(err)
+	}
+	go scanJobs.Run(apiSettings.ScanJobWorkers, time.Duration(apiSettings.ScanJobRetention)*time.Second)
 	// Start webserver
 	startHTTP()
 }
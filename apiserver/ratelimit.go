@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/paulbellamy/ratecounter"
+)
+
+// rateLimit configures a token bucket
+type rateLimit struct {
+	PerMinute int // Tokens added per minute
+	Burst     int // Size of the bucket
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter is a token bucket rate limiter with one bucket per client
+type rateLimiter struct {
+	limit   rateLimit
+	lock    sync.Mutex
+	buckets map[string]*bucket
+	limited *ratecounter.RateCounter
+}
+
+func newRateLimiter(limit rateLimit) *rateLimiter {
+	l := &rateLimiter{
+		limit:   limit,
+		buckets: make(map[string]*bucket),
+		limited: ratecounter.NewRateCounter(time.Minute),
+	}
+	go l.cleanup()
+	return l
+}
+
+// rate returns the number of tokens added per second
+func (l *rateLimiter) rate() float64 {
+	return float64(l.limit.PerMinute) / 60
+}
+
+// Take tries to take n tokens from the bucket of id. Requests are allowed while there is a token left,
+// larger requests put the bucket into debt, so the client has to wait longer for the next one.
+// It returns whether the request is allowed, the remaining tokens and the time until the next token is available.
+func (l *rateLimiter) Take(id string, n int) (bool, int, time.Duration) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	now := time.Now()
+	b, ok := l.buckets[id]
+	if !ok {
+		b = &bucket{tokens: float64(l.limit.Burst), last: now}
+		l.buckets[id] = b
+	}
+	// Refill
+	b.tokens = math.Min(float64(l.limit.Burst), b.tokens+now.Sub(b.last).Seconds()*l.rate())
+	b.last = now
+	// Take
+	allowed := b.tokens >= 1
+	if allowed {
+		b.tokens -= float64(n)
+	} else {
+		l.limited.Incr(1)
+	}
+	wait := time.Duration(0)
+	if b.tokens < 1 && l.rate() > 0 {
+		wait = time.Duration((1 - b.tokens) / l.rate() * float64(time.Second))
+	}
+	return allowed, int(math.Max(b.tokens, 0)), wait
+}
+
+// Len returns the number of clients with a bucket
+func (l *rateLimiter) Len() int {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return len(l.buckets)
+}
+
+// cleanup removes buckets that are full again
+func (l *rateLimiter) cleanup() {
+	for {
+		time.Sleep(time.Minute)
+		l.lock.Lock()
+		now := time.Now()
+		for id, b := range l.buckets {
+			if b.tokens+now.Sub(b.last).Seconds()*l.rate() >= float64(l.limit.Burst) {
+				delete(l.buckets, id)
+			}
+		}
+		l.lock.Unlock()
+	}
+}
+
+// routeLimiters holds the rate limiters for client IPs and API keys per route
+type routeLimiters struct {
+	ip  map[string]*rateLimiter
+	key map[string]*rateLimiter
+}
+
+func newRouteLimiters(s settings) routeLimiters {
+	limiters := routeLimiters{
+		ip:  make(map[string]*rateLimiter),
+		key: make(map[string]*rateLimiter),
+	}
+	for route, limit := range s.RateLimits {
+		limiters.ip[route] = newRateLimiter(limit)
+	}
+	for route, limit := range s.KeyRateLimits {
+		limiters.key[route] = newRateLimiter(limit)
+	}
+	return limiters
+}
+
+// AllowIP checks the limit of the route of the request for the client IP and sets the rate limit headers
+func (rl routeLimiters) AllowIP(w http.ResponseWriter, r *http.Request, remoteAddr string) bool {
+	return allow(w, rl.ip[r.URL.Path], remoteAddr, 1)
+}
+
+// AllowKey checks the limit of the route of the request for an authenticated API key and sets the rate limit headers
+func (rl routeLimiters) AllowKey(w http.ResponseWriter, r *http.Request, public string) bool {
+	return allow(w, rl.key[r.URL.Path], public, 1)
+}
+
+// AllowN charges n tokens for the client IP and, if not empty, the API key (e.g. for the locations of a scan job)
+func (rl routeLimiters) AllowN(w http.ResponseWriter, r *http.Request, remoteAddr, public string, n int) bool {
+	allowed := allow(w, rl.ip[r.URL.Path], remoteAddr, n)
+	if public != "" {
+		allowed = allow(w, rl.key[r.URL.Path], public, n) && allowed
+	}
+	return allowed
+}
+
+// allow takes n tokens from the bucket of id, if there is a limiter.
+// When the headers are set already, the limit with less remaining tokens is reported.
+func allow(w http.ResponseWriter, l *rateLimiter, id string, n int) bool {
+	if l == nil {
+		return true
+	}
+	allowed, remaining, wait := l.Take(id, n)
+	reset := strconv.Itoa(int(math.Ceil(wait.Seconds())))
+	if previous, err := strconv.Atoi(w.Header().Get("X-RateLimit-Remaining")); err != nil || remaining < previous {
+		w.Header().Set("X-RateLimit-Limit", strconv.Itoa(l.limit.Burst))
+		w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(remaining))
+		w.Header().Set("X-RateLimit-Reset", reset)
+	}
+	if !allowed {
+		w.Header().Set("Retry-After", reset)
+	}
+	return allowed
+}
+
+type rateLimiterData struct {
+	Clients          int   `json:"clients"`
+	LimitedPerMinute int64 `json:"limited_per_minute"`
+}
+
+func (rl routeLimiters) String() string {
+	data := map[string]map[string]rateLimiterData{"ip": {}, "key": {}}
+	for route, l := range rl.ip {
+		data["ip"][route] = rateLimiterData{Clients: l.Len(), LimitedPerMinute: l.limited.Rate()}
+	}
+	for route, l := range rl.key {
+		data["key"][route] = rateLimiterData{Clients: l.Len(), LimitedPerMinute: l.limited.Rate()}
+	}
+	b, _ := json.Marshal(data)
+	return string(b)
+}
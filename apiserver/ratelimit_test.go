@@ -0,0 +1,48 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiterTake(t *testing.T) {
+	tests := []struct {
+		name    string
+		limit   rateLimit
+		takes   []int
+		allowed []bool
+	}{
+		{"burst", rateLimit{PerMinute: 1, Burst: 3}, []int{1, 1, 1, 1}, []bool{true, true, true, false}},
+		{"debt", rateLimit{PerMinute: 1, Burst: 3}, []int{5, 1}, []bool{true, false}},
+		{"last token", rateLimit{PerMinute: 1, Burst: 3}, []int{2, 3, 1}, []bool{true, true, false}},
+		{"empty bucket", rateLimit{PerMinute: 1, Burst: 0}, []int{1}, []bool{false}},
+	}
+	for _, test := range tests {
+		l := newRateLimiter(test.limit)
+		for i, n := range test.takes {
+			allowed, _, _ := l.Take("client", n)
+			if allowed != test.allowed[i] {
+				t.Errorf("%s: take %d of %d tokens: got allowed=%v, want %v", test.name, i, n, allowed, test.allowed[i])
+			}
+		}
+	}
+}
+
+func TestRateLimiterRefill(t *testing.T) {
+	l := newRateLimiter(rateLimit{PerMinute: 60, Burst: 2})
+	if allowed, remaining, _ := l.Take("client", 2); !allowed || remaining != 0 {
+		t.Fatalf("got allowed=%v remaining=%d, want true 0", allowed, remaining)
+	}
+	if allowed, _, wait := l.Take("client", 1); allowed || wait <= 0 || wait > time.Second {
+		t.Fatalf("got allowed=%v wait=%s, want false and a wait of up to 1s", allowed, wait)
+	}
+	// Ten seconds later the bucket is full again, but not fuller
+	l.buckets["client"].last = time.Now().Add(-10 * time.Second)
+	if allowed, remaining, _ := l.Take("client", 1); !allowed || remaining != 1 {
+		t.Fatalf("got allowed=%v remaining=%d, want true 1", allowed, remaining)
+	}
+	// Other clients have their own bucket
+	if allowed, _, _ := l.Take("other", 1); !allowed {
+		t.Fatal("other client was limited")
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/kellydunn/golang-geo"
+	"github.com/pogointel/opm/opm"
+)
+
+const (
+	// reputationScanRadius is the radius (in meters) around a scan location in which the scanner sees all Pokemon
+	reputationScanRadius = 70
+	// reputationMatchDistance is the maximum distance (in meters) between a submitted and a scanned Pokemon to count as the same
+	reputationMatchDistance = 30
+	// reputationMatchExpiry is the maximum difference (in seconds) between the expiry of a submitted and a scanned Pokemon
+	reputationMatchExpiry = 120
+	// reputationUpdateInterval is the time between score updates
+	reputationUpdateInterval = time.Minute
+)
+
+// reputationTracker scores API keys by the quality of their submissions.
+// Submitted Pokemon are cross-checked against the results of scans in the same area.
+type reputationTracker struct {
+	lock    sync.Mutex
+	stats   map[string]*opm.Reputation
+	pending map[string]opm.MapObject
+}
+
+func newReputationTracker() *reputationTracker {
+	return &reputationTracker{
+		stats:   make(map[string]*opm.Reputation),
+		pending: make(map[string]opm.MapObject),
+	}
+}
+
+func (t *reputationTracker) reputation(key opm.APIKey) *opm.Reputation {
+	r, ok := t.stats[key.PublicKey]
+	if !ok {
+		r = &opm.Reputation{}
+		*r = key.Reputation
+		t.stats[key.PublicKey] = r
+	}
+	return r
+}
+
+// Submitted records the result of a submission
+func (t *reputationTracker) Submitted(key opm.APIKey, object opm.MapObject, err error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	r := t.reputation(key)
+	r.Submitted++
+	switch {
+	case err == opm.ErrPokemonExpired:
+		r.Expired++
+	case err != nil:
+		r.Invalid++
+	case object.Type == opm.POKEMON:
+		// Remember Pokemon for cross-checking with scans
+		object.Source = key.PublicKey
+		t.pending[object.Source+object.ID] = object
+	}
+}
+
+// Scanned cross-checks pending submissions with the result of a scan at lat/lng
+func (t *reputationTracker) Scanned(lat, lng float64, objects []opm.MapObject) {
+	now := time.Now().Unix()
+	center := geo.NewPoint(lat, lng)
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for id, p := range t.pending {
+		if p.Expiry <= now {
+			delete(t.pending, id)
+			continue
+		}
+		point := geo.NewPoint(p.Lat, p.Lng)
+		if center.GreatCircleDistance(point)*1000 > reputationScanRadius {
+			continue
+		}
+		// The scanner must have seen this Pokemon
+		confirmed := false
+		for _, o := range objects {
+			if o.Type != opm.POKEMON {
+				continue
+			}
+			if o.ID == p.ID || (o.PokemonID == p.PokemonID &&
+				point.GreatCircleDistance(geo.NewPoint(o.Lat, o.Lng))*1000 <= reputationMatchDistance &&
+				math.Abs(float64(o.Expiry-p.Expiry)) <= reputationMatchExpiry) {
+				confirmed = true
+				break
+			}
+		}
+		r := t.stats[p.Source]
+		if r == nil {
+			continue
+		}
+		if confirmed {
+			r.Confirmed++
+		} else {
+			r.Contradicted++
+		}
+		delete(t.pending, id)
+	}
+}
+
+// Run updates the scores periodically, stores them and disables or quarantines bad keys
+func (t *reputationTracker) Run() {
+	for {
+		time.Sleep(reputationUpdateInterval)
+		t.update()
+	}
+}
+
+func (t *reputationTracker) update() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	now := time.Now().Unix()
+	// Remove expired Pokemon
+	for id, p := range t.pending {
+		if p.Expiry <= now {
+			delete(t.pending, id)
+		}
+	}
+	for public, r := range t.stats {
+		key, err := database.GetAPIKey(public)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		// Reputation was reset (e.g. when the key was enabled again)
+		if key.Reputation.Updated != r.Updated {
+			*r = key.Reputation
+		}
+		previous := r.Updated
+		decayReputation(r, now, apiSettings.ReputationHalfLife)
+		r.Score = reputationScore(*r, apiSettings.ReputationMinSamples)
+		r.Updated = now
+		err = database.UpdateReputation(public, previous, *r)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		// Enforce thresholds
+		enabled, quarantined, reason := key.Enabled, key.Quarantined, key.DisabledReason
+		switch {
+		case r.Score < apiSettings.ReputationDisableScore && key.Enabled:
+			enabled = false
+			reason = fmt.Sprintf("Disabled automatically: reputation %.2f (%s)", r.Score, reputationSummary(*r))
+		case r.Score < apiSettings.ReputationQuarantineScore && key.Enabled && !key.Quarantined:
+			quarantined = true
+			reason = fmt.Sprintf("Quarantined automatically: reputation %.2f (%s)", r.Score, reputationSummary(*r))
+		case r.Score >= apiSettings.ReputationQuarantineScore && key.Quarantined:
+			quarantined = false
+			reason = ""
+		default:
+			continue
+		}
+		if reason != "" {
+			log.Printf("Key %s: %s", key.Name, reason)
+		} else {
+			log.Printf("Key %s: quarantine lifted (reputation %.2f)", key.Name, r.Score)
+		}
+		err = database.SetAPIKeyStatus(public, enabled, quarantined, reason)
+		if err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// decayReputation lets the counters decay with the given half-life (in hours)
+func decayReputation(r *opm.Reputation, now int64, halfLife int) {
+	if r.Updated == 0 || halfLife <= 0 {
+		return
+	}
+	factor := math.Pow(0.5, float64(now-r.Updated)/float64(halfLife*3600))
+	r.Submitted *= factor
+	r.Invalid *= factor
+	r.Expired *= factor
+	r.Confirmed *= factor
+	r.Contradicted *= factor
+}
+
+// reputationScore combines the ratio of invalid/expired submissions and the ratio of contradicted Pokemon.
+// Keys with less than minSamples submissions get a perfect score.
+func reputationScore(r opm.Reputation, minSamples int) float64 {
+	if r.Submitted < float64(minSamples) {
+		return 1
+	}
+	score := 1 - (r.Invalid+r.Expired)/r.Submitted
+	checked := r.Confirmed + r.Contradicted
+	if checked >= float64(minSamples)/10 {
+		score *= r.Confirmed / checked
+	}
+	return score
+}
+
+func reputationSummary(r opm.Reputation) string {
+	return fmt.Sprintf("%.0f submitted, %.0f invalid, %.0f expired, %.0f confirmed, %.0f contradicted",
+		r.Submitted, r.Invalid, r.Expired, r.Confirmed, r.Contradicted)
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pogointel/opm/opm"
+	"github.com/pogointel/opm/util"
+)
+
+// scannerBusyBackoff is the time a scanner isn't used after it answered with ErrBusy
+const scannerBusyBackoff = 5 * time.Second
+
+// scannerRequestBudget is the time for a scan request including retries. It leaves some of the writeTimeout for the response.
+const scannerRequestBudget = writeTimeout - 5*time.Second
+
+// scannerConfig configures a scanner instance
+type scannerConfig struct {
+	Address string       // host:port of the scanner
+	Regions []opm.Region // Scans inside these regions prefer this scanner (optional)
+}
+
+// scannerBackend is the state of a scanner instance
+type scannerBackend struct {
+	scannerConfig
+	Healthy        bool   `json:"healthy"`
+	Failures       int    `json:"failures"` // Consecutive failed requests
+	InFlight       int    `json:"in_flight"`
+	Accounts       int    `json:"accounts"` // Accounts in use (from /debug/vars)
+	BusyPerMinute  int64  `json:"busy_per_minute"`
+	FailsPerMinute int64  `json:"fails_per_minute"`
+	LastError      string `json:"last_error,omitempty"`
+	busyUntil      time.Time
+}
+
+// load estimates how busy the scanner is. Lower is better.
+func (b *scannerBackend) load() float64 {
+	accounts := b.Accounts
+	if accounts < 1 {
+		accounts = 1
+	}
+	return float64(b.InFlight)/float64(accounts) + float64(b.BusyPerMinute+b.FailsPerMinute)/60
+}
+
+// scannerPool distributes /scan requests across scanner instances.
+// The least busy healthy scanner is used, scanners with a matching region are preferred.
+// Scanners are checked actively (/debug/vars) and passively (failed requests).
+// The client address is forwarded in X-Forwarded-For. Scanners on other hosts only use it, if the address
+// of the apiserver is in their TrustedProxies. Otherwise all clients of the apiserver count as one client.
+type scannerPool struct {
+	lock        sync.Mutex
+	backends    []*scannerBackend
+	client      *http.Client
+	retries     int
+	maxFailures int
+}
+
+func newScannerPool(s settings) *scannerPool {
+	configs := s.Scanners
+	if len(configs) == 0 {
+		configs = []scannerConfig{{Address: fmt.Sprintf("%s:%d", opmSettings.ScannerListenAddress, opmSettings.ScannerListenPort)}}
+	}
+	p := &scannerPool{
+		client:      &http.Client{Timeout: (opm.RequestTimeout + 5) * time.Second},
+		retries:     s.ScannerRetries,
+		maxFailures: s.ScannerMaxFailures,
+	}
+	for _, c := range configs {
+		// Healthy until the first check says otherwise
+		p.backends = append(p.backends, &scannerBackend{scannerConfig: c, Healthy: true})
+	}
+	return p
+}
+
+// Run checks the health and load of all scanners periodically
+func (p *scannerPool) Run(interval time.Duration) {
+	for {
+		var wg sync.WaitGroup
+		for _, b := range p.backends {
+			wg.Add(1)
+			go func(b *scannerBackend) {
+				defer wg.Done()
+				p.check(b)
+			}(b)
+		}
+		wg.Wait()
+		time.Sleep(interval)
+	}
+}
+
+// check updates the state of a scanner from its /debug/vars page
+func (p *scannerPool) check(b *scannerBackend) {
+	var vars struct {
+		Metrics struct {
+			BusyPerMinute  int64 `json:"scan_busy_per_minute"`
+			FailsPerMinute int64 `json:"scan_fails_per_minute"`
+		} `json:"scanner_metrics"`
+		Trainers util.TrainerQueueStats `json:"trainer_queue"`
+	}
+	err := p.getJSON(fmt.Sprintf("http://%s/debug/vars", b.Address), &vars)
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if err != nil {
+		if b.Healthy {
+			log.Printf("Scanner %s is down: %s", b.Address, err)
+		}
+		b.Healthy = false
+		b.LastError = err.Error()
+		return
+	}
+	if !b.Healthy {
+		log.Printf("Scanner %s is up again", b.Address)
+	}
+	b.Healthy = true
+	b.Failures = 0
+	b.LastError = ""
+	b.Accounts = vars.Trainers.Trainers
+	b.BusyPerMinute = vars.Metrics.BusyPerMinute
+	b.FailsPerMinute = vars.Metrics.FailsPerMinute
+}
+
+func (p *scannerPool) getJSON(u string, v interface{}) error {
+	resp, err := p.client.Get(u)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %d", u, resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// pick selects the scanner for a scan at lat/lng and marks the request as in flight.
+// Scanners in tried are skipped.
+func (p *scannerPool) pick(lat, lng float64, hasLocation bool, tried map[*scannerBackend]bool) *scannerBackend {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	now := time.Now()
+	var best *scannerBackend
+	bestAffinity := false
+	for _, b := range p.backends {
+		if !b.Healthy || tried[b] || now.Before(b.busyUntil) {
+			continue
+		}
+		affinity := hasLocation && util.InRegions(lat, lng, b.Regions)
+		if best == nil || (affinity && !bestAffinity) || (affinity == bestAffinity && b.load() < best.load()) {
+			best, bestAffinity = b, affinity
+		}
+	}
+	if best != nil {
+		best.InFlight++
+	}
+	return best
+}
+
+// done records the result of a request to a scanner (passive health check)
+func (p *scannerPool) done(b *scannerBackend, err error, busy bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	b.InFlight--
+	if busy {
+		b.busyUntil = time.Now().Add(scannerBusyBackoff)
+	}
+	if err == nil {
+		b.Failures = 0
+		return
+	}
+	b.Failures++
+	b.LastError = err.Error()
+	if b.Failures >= p.maxFailures && b.Healthy {
+		log.Printf("Scanner %s failed %d times: %s", b.Address, b.Failures, err)
+		b.Healthy = false
+	}
+}
+
+// ServeHTTP forwards a scan request to a scanner. Busy scanners are retried with another one.
+func (p *scannerPool) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	remoteAddr := clientIP(r)
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	// Location for region affinity
+	form, _ := url.ParseQuery(string(body))
+	lat, latErr := strconv.ParseFloat(form.Get("lat"), 64)
+	lng, lngErr := strconv.ParseFloat(form.Get("lng"), 64)
+	hasLocation := latErr == nil && lngErr == nil
+	// Only scan jobs are internal requests
+	r.Header.Del(util.SecretHeader)
+
+	ctx, cancel := context.WithTimeout(r.Context(), scannerRequestBudget)
+	defer cancel()
+	resp, err := p.do(ctx, r.Method, r.URL.RequestURI(), r.Header, body, remoteAddr, lat, lng, hasLocation)
+	if err == opm.ErrScanTimeout {
+		w.Header().Add("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(opm.APIResponse{Error: err.Error()})
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	if resp == nil {
+		// No scanner available
+		w.Header().Add("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(opm.APIResponse{Error: opm.ErrBusy.Error()})
+		return
+	}
+	for k, v := range resp.header {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(resp.status)
+	w.Write(resp.body)
+}
+
+// Scan runs a scan at lat/lng on one of the scanners
+func (p *scannerPool) Scan(lat, lng float64, remoteAddr string) (opm.APIResponse, error) {
+	form := url.Values{}
+	form.Set("lat", strconv.FormatFloat(lat, 'f', -1, 64))
+	form.Set("lng", strconv.FormatFloat(lng, 'f', -1, 64))
+	header := http.Header{"Content-Type": {"application/x-www-form-urlencoded"}}
+	// Scan jobs were verified and charged by the apiserver already
+	if opmSettings.Secret != "" {
+		header.Set(util.SecretHeader, opmSettings.Secret)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), scannerRequestBudget)
+	defer cancel()
+	resp, err := p.do(ctx, "POST", "/scan", header, []byte(form.Encode()), remoteAddr, lat, lng, true)
+	if err != nil {
+		return opm.APIResponse{}, err
+	}
+	if resp == nil {
+		return opm.APIResponse{Error: opm.ErrBusy.Error()}, nil
+	}
+	var response opm.APIResponse
+	err = json.Unmarshal(resp.body, &response)
+	return response, err
+}
+
+// do sends a request to the best scanner. Busy scanners are retried with another one until the context is done.
+// It returns nil, if no scanner is available.
+func (p *scannerPool) do(ctx context.Context, method, uri string, header http.Header, body []byte, remoteAddr string, lat, lng float64, hasLocation bool) (*scannerResponse, error) {
+	tried := make(map[*scannerBackend]bool)
+	var resp *scannerResponse
+	var lastErr error
+	for i := 0; i <= p.retries && ctx.Err() == nil; i++ {
+		b := p.pick(lat, lng, hasLocation, tried)
+		if b == nil {
+			break
+		}
+		tried[b] = true
+		sr, err := p.forward(ctx, b, method, uri, header, body, remoteAddr)
+		if err != nil && ctx.Err() != nil {
+			// Out of time, that's not the fault of the scanner
+			p.done(b, nil, false)
+			if resp == nil {
+				return nil, opm.ErrScanTimeout
+			}
+			break
+		}
+		if err != nil {
+			p.done(b, err, false)
+			lastErr = err
+			continue
+		}
+		busy := sr.busy()
+		p.done(b, nil, busy)
+		resp = sr
+		if !busy {
+			break
+		}
+	}
+	if resp == nil {
+		return nil, lastErr
+	}
+	return resp, nil
+}
+
+type scannerResponse struct {
+	status int
+	header http.Header
+	body   []byte
+}
+
+func (r *scannerResponse) busy() bool {
+	var response opm.APIResponse
+	return json.Unmarshal(r.body, &response) == nil && !response.Ok && response.Error == opm.ErrBusy.Error()
+}
+
+// forward sends the request to a scanner
+func (p *scannerPool) forward(ctx context.Context, b *scannerBackend, method, uri string, header http.Header, body []byte, remoteAddr string) (*scannerResponse, error) {
+	req, err := http.NewRequest(method, fmt.Sprintf("http://%s%s", b.Address, uri), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	// Pass the resolved client IP on to the scanner
+	for _, h := range opmSettings.ClientIPHeaders {
+		req.Header.Del(h)
+	}
+	req.Header.Set("X-Forwarded-For", remoteAddr)
+	// The response is encoded again by publishScanResults
+	req.Header.Del("Accept-Encoding")
+	req.Header.Del("Connection")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 500 {
+		return nil, fmt.Errorf("Scanner returned %d", resp.StatusCode)
+	}
+	respHeader := make(http.Header)
+	for _, h := range []string{"Content-Type", "Retry-After"} {
+		if v := resp.Header.Get(h); v != "" {
+			respHeader.Set(h, v)
+		}
+	}
+	return &scannerResponse{status: resp.StatusCode, header: respHeader, body: respBody}, nil
+}
+
+func (p *scannerPool) String() string {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	b, _ := json.Marshal(p.backends)
+	return string(b)
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/kellydunn/golang-geo"
+	"github.com/paulbellamy/ratecounter"
+	"github.com/pogointel/opm/opm"
+	"github.com/pogointel/opm/util"
+)
+
+const (
+	// spatialCachePrecision is the geohash precision of the cells (about 1.2km x 0.6km)
+	spatialCachePrecision = 6
+	// spatialCacheSweepInterval is the time between removals of expired objects and idle cells
+	spatialCacheSweepInterval = 30 * time.Second
+)
+
+var allMapObjectTypes = []int{opm.POKEMON, opm.POKESTOP, opm.GYM}
+
+// spatialCell holds all MapObjects of one geohash cell
+type spatialCell struct {
+	objects map[string]opm.MapObject
+	loaded  time.Time // Last time the cell was loaded from the db
+	used    time.Time // Last time the cell was read
+}
+
+// spatialCache keeps the MapObjects of recently requested areas in memory.
+// Cells are loaded from the db on the first request and reloaded after the TTL.
+// New objects (from /submit and /scan) are added to cells that are already loaded.
+type spatialCache struct {
+	lock   sync.RWMutex
+	cells  map[string]*spatialCell
+	ttl    time.Duration
+	max    int
+	hits   *ratecounter.RateCounter
+	misses *ratecounter.RateCounter
+}
+
+func newSpatialCache(s settings) *spatialCache {
+	return &spatialCache{
+		cells:  make(map[string]*spatialCell),
+		ttl:    time.Duration(s.SpatialCacheTTL) * time.Second,
+		max:    s.SpatialCacheMaxCells,
+		hits:   ratecounter.NewRateCounter(time.Minute),
+		misses: ratecounter.NewRateCounter(time.Minute),
+	}
+}
+
+// GetMapObjects returns the objects around lat/lng like database.GetMapObjects
+func (c *spatialCache) GetMapObjects(lat, lng float64, filter opm.MapObjectFilter) ([]opm.MapObject, error) {
+	hashes := util.GeohashesAround(lat, lng, float64(filter.Radius), spatialCachePrecision)
+	// Too big for the cache
+	if len(hashes) > c.max {
+		c.misses.Incr(1)
+		return database.GetMapObjects(lat, lng, filter)
+	}
+	// Load missing cells
+	now := time.Now()
+	var cold []string
+	c.lock.RLock()
+	for _, h := range hashes {
+		cell, ok := c.cells[h]
+		if !ok || now.Sub(cell.loaded) > c.ttl {
+			cold = append(cold, h)
+		}
+	}
+	c.lock.RUnlock()
+	if len(cold) > 0 {
+		c.misses.Incr(1)
+		for _, h := range cold {
+			err := c.load(h)
+			if err != nil {
+				return nil, err
+			}
+		}
+	} else {
+		c.hits.Incr(1)
+	}
+	// Collect objects
+	center := geo.NewPoint(lat, lng)
+	type result struct {
+		object   opm.MapObject
+		distance float64
+	}
+	var results []result
+	unix := now.Unix()
+	c.lock.Lock()
+	for _, h := range hashes {
+		cell, ok := c.cells[h]
+		if !ok {
+			continue
+		}
+		cell.used = now
+		for _, o := range cell.objects {
+			if !filter.Matches(o, unix) {
+				continue
+			}
+			d := center.GreatCircleDistance(geo.NewPoint(o.Lat, o.Lng)) * 1000
+			if d <= float64(filter.Radius) {
+				results = append(results, result{o, d})
+			}
+		}
+	}
+	c.lock.Unlock()
+	// Sort and limit
+	sort.Slice(results, func(i, j int) bool {
+		if filter.Sort == opm.SortExpiry {
+			return results[i].object.Expiry < results[j].object.Expiry
+		}
+		return results[i].distance < results[j].distance
+	})
+	if filter.Limit > 0 && len(results) > filter.Limit {
+		results = results[:filter.Limit]
+	}
+	objects := make([]opm.MapObject, len(results))
+	for i, r := range results {
+		objects[i] = r.object
+	}
+	return objects, nil
+}
+
+// load replaces a cell with the objects from the db
+func (c *spatialCache) load(hash string) error {
+	lat, lng := util.GeohashCenter(hash)
+	height, width := util.GeohashSize(spatialCachePrecision)
+	// Circle around the cell
+	radius := math.Hypot(height*111320, width*111320*math.Cos(lat*math.Pi/180))/2 + 1
+	objects, err := database.GetMapObjects(lat, lng, opm.MapObjectFilter{Types: allMapObjectTypes, Radius: int(math.Ceil(radius))})
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	cell := &spatialCell{objects: make(map[string]opm.MapObject), loaded: now, used: now}
+	for _, o := range objects {
+		if util.Geohash(o.Lat, o.Lng, spatialCachePrecision) == hash {
+			cell.objects[o.ID] = o
+		}
+	}
+	c.lock.Lock()
+	c.cells[hash] = cell
+	c.lock.Unlock()
+	return nil
+}
+
+// Add puts new objects into the cells that are already loaded
+func (c *spatialCache) Add(objects []opm.MapObject) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for _, o := range objects {
+		if cell, ok := c.cells[util.Geohash(o.Lat, o.Lng, spatialCachePrecision)]; ok {
+			cell.objects[o.ID] = o
+		}
+	}
+}
+
+// Run removes expired objects and cells that weren't used for a while
+func (c *spatialCache) Run() {
+	for {
+		time.Sleep(spatialCacheSweepInterval)
+		now := time.Now()
+		c.lock.Lock()
+		for h, cell := range c.cells {
+			if now.Sub(cell.used) > c.ttl {
+				delete(c.cells, h)
+				continue
+			}
+			for id, o := range cell.objects {
+				if o.Expiry != 0 && o.Expiry <= now.Unix() {
+					delete(cell.objects, id)
+				}
+			}
+		}
+		// Drop the least recently used cells
+		if len(c.cells) > c.max {
+			hashes := make([]string, 0, len(c.cells))
+			for h := range c.cells {
+				hashes = append(hashes, h)
+			}
+			sort.Slice(hashes, func(i, j int) bool { return c.cells[hashes[i]].used.Before(c.cells[hashes[j]].used) })
+			for _, h := range hashes[:len(hashes)-c.max] {
+				delete(c.cells, h)
+			}
+		}
+		c.lock.Unlock()
+	}
+}
+
+type spatialCacheData struct {
+	Cells           int     `json:"cells"`
+	Objects         int     `json:"objects"`
+	HitsPerMinute   int64   `json:"hits_per_minute"`
+	MissesPerMinute int64   `json:"misses_per_minute"`
+	HitRate         float64 `json:"hit_rate"`
+}
+
+func (c *spatialCache) String() string {
+	c.lock.RLock()
+	data := spatialCacheData{Cells: len(c.cells)}
+	for _, cell := range c.cells {
+		data.Objects += len(cell.objects)
+	}
+	c.lock.RUnlock()
+	data.HitsPerMinute = c.hits.Rate()
+	data.MissesPerMinute = c.misses.Rate()
+	if total := data.HitsPerMinute + data.MissesPerMinute; total > 0 {
+		data.HitRate = float64(data.HitsPerMinute) / float64(total)
+	}
+	b, _ := json.Marshal(data)
+	return string(b)
+}
@@ -2,9 +2,11 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"sync"
 	"time"
 
 	"github.com/paulbellamy/ratecounter"
@@ -64,32 +66,72 @@ func NewBuffer(cap int) *RingBuffer {
 // APIMetrics stores metrics for API keys
 type KeyMetrics map[string]APIKeyMetrics
 
+var keyMetricsLock sync.RWMutex
+
 type APIMetrics struct {
-	KeyMetrics                  KeyMetrics
-	BlockedRequestsPerMinute    *ratecounter.RateCounter
-	SecurityCheckFailsPerMinute *ratecounter.RateCounter
-	ScansPerMinute              *ratecounter.RateCounter
-	ScanFailsPerMinute          *ratecounter.RateCounter
-	ScanBusyPerMinute           *ratecounter.RateCounter
-	ScanResponseTimesMs         *RingBuffer
-	CacheRequestsPerMinute      *ratecounter.RateCounter
-	CacheRequestFailsPerMinute  *ratecounter.RateCounter
-	CacheResponseTimesNs        *RingBuffer
+	KeyMetrics                   KeyMetrics
+	BlockedRequestsPerMinute     *ratecounter.RateCounter
+	RateLimitedRequestsPerMinute *ratecounter.RateCounter
+	SecurityCheckFailsPerMinute  *ratecounter.RateCounter
+	ScansPerMinute               *ratecounter.RateCounter
+	ScanFailsPerMinute           *ratecounter.RateCounter
+	ScanBusyPerMinute            *ratecounter.RateCounter
+	ScanResponseTimesMs          *RingBuffer
+	CacheRequestsPerMinute       *ratecounter.RateCounter
+	CacheRequestFailsPerMinute   *ratecounter.RateCounter
+	CacheResponseTimesNs         *RingBuffer
+	WebhooksSentPerMinute        *ratecounter.RateCounter
+	WebhooksFailedPerMinute      *ratecounter.RateCounter
+	WebhooksDroppedPerMinute     *ratecounter.RateCounter
+	LiveClientsDroppedPerMinute  *ratecounter.RateCounter
 }
 
 func NewAPIMetrics() *APIMetrics {
 	return &APIMetrics{
-		KeyMetrics:                  make(map[string]APIKeyMetrics),
-		BlockedRequestsPerMinute:    ratecounter.NewRateCounter(time.Minute),
-		SecurityCheckFailsPerMinute: ratecounter.NewRateCounter(time.Minute),
-		ScansPerMinute:              ratecounter.NewRateCounter(time.Minute),
-		ScanFailsPerMinute:          ratecounter.NewRateCounter(time.Minute),
-		ScanBusyPerMinute:           ratecounter.NewRateCounter(time.Minute),
-		ScanResponseTimesMs:         NewBuffer(256),
-		CacheRequestsPerMinute:      ratecounter.NewRateCounter(time.Minute),
-		CacheRequestFailsPerMinute:  ratecounter.NewRateCounter(time.Minute),
-		CacheResponseTimesNs:        NewBuffer(256),
+		KeyMetrics:                   make(map[string]APIKeyMetrics),
+		BlockedRequestsPerMinute:     ratecounter.NewRateCounter(time.Minute),
+		RateLimitedRequestsPerMinute: ratecounter.NewRateCounter(time.Minute),
+		SecurityCheckFailsPerMinute:  ratecounter.NewRateCounter(time.Minute),
+		ScansPerMinute:               ratecounter.NewRateCounter(time.Minute),
+		ScanFailsPerMinute:           ratecounter.NewRateCounter(time.Minute),
+		ScanBusyPerMinute:            ratecounter.NewRateCounter(time.Minute),
+		ScanResponseTimesMs:          NewBuffer(256),
+		CacheRequestsPerMinute:       ratecounter.NewRateCounter(time.Minute),
+		CacheRequestFailsPerMinute:   ratecounter.NewRateCounter(time.Minute),
+		CacheResponseTimesNs:         NewBuffer(256),
+		WebhooksSentPerMinute:        ratecounter.NewRateCounter(time.Minute),
+		WebhooksFailedPerMinute:      ratecounter.NewRateCounter(time.Minute),
+		WebhooksDroppedPerMinute:     ratecounter.NewRateCounter(time.Minute),
+		LiveClientsDroppedPerMinute:  ratecounter.NewRateCounter(time.Minute),
+	}
+}
+
+type apiMetricsData struct {
+	BlockedRequestsPerMinute     int64 `json:"blocked_requests_per_minute"`
+	RateLimitedRequestsPerMinute int64 `json:"rate_limited_requests_per_minute"`
+	SecurityCheckFailsPerMinute  int64 `json:"security_check_fails_per_minute"`
+	CacheRequestFailsPerMinute   int64 `json:"cache_fails_per_minute"`
+	WebhooksSentPerMinute        int64 `json:"webhooks_sent_per_minute"`
+	WebhooksFailedPerMinute      int64 `json:"webhooks_failed_per_minute"`
+	WebhooksDroppedPerMinute     int64 `json:"webhooks_dropped_per_minute"`
+	LiveClients                  int   `json:"live_clients"`
+	LiveClientsDroppedPerMinute  int64 `json:"live_clients_dropped_per_minute"`
+}
+
+func (m *APIMetrics) String() string {
+	data := apiMetricsData{
+		BlockedRequestsPerMinute:     m.BlockedRequestsPerMinute.Rate(),
+		RateLimitedRequestsPerMinute: m.RateLimitedRequestsPerMinute.Rate(),
+		SecurityCheckFailsPerMinute:  m.SecurityCheckFailsPerMinute.Rate(),
+		CacheRequestFailsPerMinute:   m.CacheRequestFailsPerMinute.Rate(),
+		WebhooksSentPerMinute:        m.WebhooksSentPerMinute.Rate(),
+		WebhooksFailedPerMinute:      m.WebhooksFailedPerMinute.Rate(),
+		WebhooksDroppedPerMinute:     m.WebhooksDroppedPerMinute.Rate(),
+		LiveClients:                  live.Len(),
+		LiveClientsDroppedPerMinute:  m.LiveClientsDroppedPerMinute.Rate(),
 	}
+	b, _ := json.Marshal(data)
+	return string(b)
 }
 
 type metrics struct {
@@ -102,6 +144,8 @@ type metrics struct {
 func (m KeyMetrics) String() string {
 	var metricList []APIKeyMetricsRaw
 	metrics := metrics{}
+	keyMetricsLock.RLock()
+	defer keyMetricsLock.RUnlock()
 	for _, v := range m {
 		metricList = append(metricList, v.Eval())
 		metrics.InvalidPerMinute += v.InvalidCounter.Rate()
@@ -113,55 +157,159 @@ func (m KeyMetrics) String() string {
 	return string(b)
 }
 
+// getKeyMetrics returns the metrics for a key and creates them, if they don't exist yet
+func getKeyMetrics(key opm.APIKey) APIKeyMetrics {
+	keyMetricsLock.Lock()
+	defer keyMetricsLock.Unlock()
+	m, ok := keyMetrics[key.PublicKey]
+	if !ok {
+		m = newAPIKeyMetrics(key)
+		keyMetrics[key.PublicKey] = m
+	}
+	return m
+}
+
 // APIKeyMetrics stores metrics about individual API keys
 type APIKeyMetrics struct {
-	Key            opm.APIKey
-	InvalidCounter *ratecounter.RateCounter
-	PokemonCounter *ratecounter.RateCounter
-	ExpiredCounter *ratecounter.RateCounter
+	Key                opm.APIKey
+	InvalidCounter     *ratecounter.RateCounter
+	PokemonCounter     *ratecounter.RateCounter
+	ExpiredCounter     *ratecounter.RateCounter
+	UnsignedCounter    *ratecounter.RateCounter
+	OutOfRegionCounter *ratecounter.RateCounter
 }
 
 func newAPIKeyMetrics(key opm.APIKey) APIKeyMetrics {
 	return APIKeyMetrics{
-		Key:            key,
-		InvalidCounter: ratecounter.NewRateCounter(time.Minute),
-		PokemonCounter: ratecounter.NewRateCounter(time.Minute),
-		ExpiredCounter: ratecounter.NewRateCounter(time.Minute),
+		Key:                key,
+		InvalidCounter:     ratecounter.NewRateCounter(time.Minute),
+		PokemonCounter:     ratecounter.NewRateCounter(time.Minute),
+		ExpiredCounter:     ratecounter.NewRateCounter(time.Minute),
+		UnsignedCounter:    ratecounter.NewRateCounter(time.Minute),
+		OutOfRegionCounter: ratecounter.NewRateCounter(time.Minute),
 	}
 }
 
 type APIKeyMetricsRaw struct {
-	Key              string
-	InvalidPerMinute int64
-	PokemonPerMinute int64
-	ExpiredPerMinute int64
+	Key                  string
+	InvalidPerMinute     int64
+	PokemonPerMinute     int64
+	ExpiredPerMinute     int64
+	UnsignedPerMinute    int64
+	OutOfRegionPerMinute int64
 }
 
 func (m APIKeyMetrics) Eval() APIKeyMetricsRaw {
 	return APIKeyMetricsRaw{
-		Key:              m.Key.Name,
-		InvalidPerMinute: m.InvalidCounter.Rate(),
-		PokemonPerMinute: m.PokemonCounter.Rate(),
-		ExpiredPerMinute: m.ExpiredCounter.Rate(),
+		Key:                  m.Key.Name,
+		InvalidPerMinute:     m.InvalidCounter.Rate(),
+		PokemonPerMinute:     m.PokemonCounter.Rate(),
+		ExpiredPerMinute:     m.ExpiredCounter.Rate(),
+		UnsignedPerMinute:    m.UnsignedCounter.Rate(),
+		OutOfRegionPerMinute: m.OutOfRegionCounter.Rate(),
 	}
 }
 
 type settings struct {
 	StaticFilesDir string
+	// Webhooks
+	WebhookBatchSize      int    // Maximum number of MapObjects per webhook request
+	WebhookFlushInterval  int    // Time between webhook requests per subscriber in milliseconds
+	WebhookRetries        int    // Number of retries for failed webhook requests
+	WebhookDeadLetterFile string // File for webhooks that could not be delivered
+	// Live feed
+	LiveMaxConnections      int // Maximum number of live feed connections
+	LiveMaxConnectionsPerIP int // Maximum number of live feed connections per client
+	LiveMaxViewportSize     int // Maximum diagonal of a live feed viewport in meters
+	// Rate limits per route
+	RateLimits    map[string]rateLimit // Limits per client IP
+	KeyRateLimits map[string]rateLimit // Limits per API key
+	// Request verification
+	Verifiers     map[string][]string // Verifiers per route (token, signature, pow)
+	TokenLifetime int                 // Lifetime of frontend tokens in seconds
+	PowDifficulty int                 // Number of leading zero bits for proof-of-work challenges
+	// Submissions
+	AllowUnsignedSubmit bool // Accept /submit requests that only contain the public key (deprecated)
+	// Scanners for /scan
+	Scanners              []scannerConfig // Scanner instances. Empty means ScannerListenAddress:ScannerListenPort. Remote scanners need the apiserver in their TrustedProxies.
+	ScannerHealthInterval int             // Time between health checks in seconds
+	ScannerRetries        int             // Number of other scanners to try when a scanner is busy or fails
+	ScannerMaxFailures    int             // Consecutive failed requests before a scanner is taken out
+	// Scan jobs (/scan?async=1)
+	ScanJobWorkers   int // Number of jobs that run at the same time
+	ScanJobQueueSize int // Maximum number of queued jobs
+	ScanJobPerClient int // Maximum number of queued or running jobs per client, 0 for unlimited
+	ScanJobMaxRadius int // Maximum radius of a job in meters
+	ScanJobRetention int // Time in seconds jobs and their results are kept
+	// Spatial cache for /cache
+	SpatialCacheTTL      int // Time in seconds after which cells are loaded from the db again, 0 disables the cache
+	SpatialCacheMaxCells int // Maximum number of cells in memory
+	// Requests without an API key
+	AnonymousScopes     []string // Scopes of requests without a key (cache-read, scan)
+	AnonymousDailyQuota int      // Maximum number of requests per day and client IP without a key, 0 for unlimited
+	// Key registration
+	AllowKeyRegistration bool // Anyone can create a key with /keys/register
+	EnableRegisteredKeys bool // Registered keys are enabled right away instead of waiting for an admin
+	// Reputation
+	ReputationMinSamples      int     // Minimum number of submissions before a key is scored
+	ReputationHalfLife        int     // Half-life of the reputation counters in hours
+	ReputationQuarantineScore float64 // Keys below this score are quarantined
+	ReputationDisableScore    float64 // Keys below this score are disabled
+}
+
+var defaultAPISettings = settings{
+	WebhookBatchSize:        50,
+	WebhookFlushInterval:    2000,
+	WebhookRetries:          5,
+	WebhookDeadLetterFile:   "webhooks.dead.log",
+	LiveMaxConnections:      1000,
+	LiveMaxConnectionsPerIP: 4,
+	LiveMaxViewportSize:     20000,
+	RateLimits: map[string]rateLimit{
+		"/scan":          {PerMinute: 6, Burst: 3},
+		"/cache":         {PerMinute: 60, Burst: 20},
+		"/submit":        {PerMinute: 600, Burst: 200},
+		"/keys/register": {PerMinute: 1, Burst: 3},
+		"/token":         {PerMinute: 1, Burst: 3},
+		"/challenge":     {PerMinute: 6, Burst: 3},
+	},
+	KeyRateLimits: map[string]rateLimit{
+		"/submit": {PerMinute: 600, Burst: 200},
+	},
+	Verifiers:                 map[string][]string{},
+	TokenLifetime:             3600,
+	PowDifficulty:             18,
+	AllowUnsignedSubmit:       true,
+	ScannerHealthInterval:     10,
+	ScannerRetries:            2,
+	ScannerMaxFailures:        3,
+	ScanJobWorkers:            4,
+	ScanJobQueueSize:          100,
+	ScanJobPerClient:          2,
+	ScanJobMaxRadius:          240,
+	ScanJobRetention:          3600,
+	SpatialCacheTTL:           60,
+	SpatialCacheMaxCells:      10000,
+	AnonymousScopes:           []string{opm.ScopeCacheRead, opm.ScopeScan},
+	AnonymousDailyQuota:       0,
+	ReputationMinSamples:      100,
+	ReputationHalfLife:        24,
+	ReputationQuarantineScore: 0.7,
+	ReputationDisableScore:    0.4,
 }
 
 func loadSettings() (settings, error) {
+	s := defaultAPISettings
 	// Try to find system settings file
 	bytes, err := ioutil.ReadFile("/etc/opm/api.json")
 	if err != nil {
 		// Use local config
 		bytes, err = ioutil.ReadFile("config.json")
 		if err != nil {
-			return settings{}, err
+			return s, err
 		}
 	}
 	// Unmarshal json
-	var s settings
 	err = json.Unmarshal(bytes, &s)
 	if err != nil {
 		return s, err
@@ -169,15 +317,23 @@ func loadSettings() (settings, error) {
 	return s, err
 }
 
+// check rejects settings that can't work
+func (s settings) check() error {
+	if s.WebhookBatchSize <= 0 {
+		return fmt.Errorf("WebhookBatchSize must be positive")
+	}
+	if s.WebhookFlushInterval <= 0 {
+		return fmt.Errorf("WebhookFlushInterval must be positive")
+	}
+	return nil
+}
+
 func handleFuncDecorator(inner func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		// Log start time
 		start := time.Now()
 		// Metadata
-		remoteAddr := r.RemoteAddr
-		if r.Header.Get("CF-Connecting-IP") != "" {
-			remoteAddr = r.Header.Get("CF-Connecting-IP")
-		}
+		remoteAddr := clientIP(r)
 		// Check blacklist
 		// ACAH headers
 		// Handle request
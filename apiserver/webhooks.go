@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"reflect"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pogointel/opm/opm"
+	"github.com/pogointel/opm/util"
+)
+
+// webhookQueueSize is the number of MapObjects buffered per subscriber
+const webhookQueueSize = 1000
+
+// webhookMaxPending is the number of batches per subscriber that can be delivered (and retried) at the same time
+const webhookMaxPending = 8
+
+// webhookStateTTL is how long the state of an object is remembered after it was last seen
+const webhookStateTTL = time.Hour
+
+// webhookDispatcher delivers new MapObjects to the URLs of subscribed API keys
+type webhookDispatcher struct {
+	settings    settings
+	client      *http.Client
+	deadLetters *log.Logger
+	lock        sync.RWMutex
+	subscribers map[string]*webhookSubscriber
+	stateLock   sync.Mutex
+	states      map[string]objectState // Last published state per object ID
+}
+
+// webhookSubscriber batches MapObjects for a single API key
+type webhookSubscriber struct {
+	key     opm.APIKey
+	queue   chan opm.MapObject
+	pending chan bool // Batches being delivered
+	quit    chan bool
+}
+
+// objectState is the part of a MapObject that changes over time
+type objectState struct {
+	pokemonID int
+	expiry    int64
+	lured     bool
+	team      int
+	seen      time.Time
+}
+
+func newWebhookDispatcher(s settings) (*webhookDispatcher, error) {
+	// Failed deliveries are appended to the dead letter file
+	f, err := os.OpenFile(s.WebhookDeadLetterFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &webhookDispatcher{
+		settings:    s,
+		client:      &http.Client{Timeout: opm.RequestTimeout * time.Second},
+		deadLetters: log.New(f, "", log.LstdFlags),
+		subscribers: make(map[string]*webhookSubscriber),
+		states:      make(map[string]objectState),
+	}, nil
+}
+
+// Run keeps the subscribers in sync with the API keys in the db
+func (d *webhookDispatcher) Run() {
+	for {
+		d.refresh()
+		d.pruneStates()
+		time.Sleep(time.Minute)
+	}
+}
+
+func (d *webhookDispatcher) refresh() {
+	keys, err := database.GetAPIKeys()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	// Add new and changed subscribers
+	active := make(map[string]bool)
+	for _, k := range keys {
+		if k.URL == "" || !k.Enabled {
+			continue
+		}
+		active[k.PublicKey] = true
+		if s, ok := d.subscribers[k.PublicKey]; ok {
+			if sameSubscription(s.key, k) {
+				continue
+			}
+			close(s.quit)
+		}
+		s := &webhookSubscriber{
+			key:     k,
+			queue:   make(chan opm.MapObject, webhookQueueSize),
+			pending: make(chan bool, webhookMaxPending),
+			quit:    make(chan bool),
+		}
+		d.subscribers[k.PublicKey] = s
+		go d.run(s)
+	}
+	// Remove old subscribers
+	for k, s := range d.subscribers {
+		if !active[k] {
+			close(s.quit)
+			delete(d.subscribers, k)
+		}
+	}
+}
+
+// sameSubscription checks if the delivery of a subscriber is unaffected by the changes from a to b.
+// Reputation and other fields change all the time and don't restart the subscriber.
+func sameSubscription(a, b opm.APIKey) bool {
+	return a.URL == b.URL && a.Enabled == b.Enabled && reflect.DeepEqual(a.Filter, b.Filter) &&
+		a.SealedKey == b.SealedKey && a.PrivateKeyHash == b.PrivateKeyHash && a.PrivateKey == b.PrivateKey
+}
+
+// Publish queues new and changed MapObjects for all subscribers whose filter matches
+func (d *webhookDispatcher) Publish(objects []opm.MapObject) {
+	objects = d.changed(objects)
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	for _, s := range d.subscribers {
+		for _, o := range objects {
+			// Don't send objects back to where they came from
+			if o.Source == s.key.PublicKey || !s.matches(o) {
+				continue
+			}
+			select {
+			case s.queue <- o:
+			default:
+				apiMetrics.WebhooksDroppedPerMinute.Incr(1)
+			}
+		}
+	}
+}
+
+// changed returns the MapObjects that are new or whose state changed since they were published last
+func (d *webhookDispatcher) changed(objects []opm.MapObject) []opm.MapObject {
+	now := time.Now()
+	d.stateLock.Lock()
+	defer d.stateLock.Unlock()
+	result := make([]opm.MapObject, 0, len(objects))
+	for _, o := range objects {
+		state := objectState{pokemonID: o.PokemonID, expiry: o.Expiry, lured: o.Lured, team: o.Team, seen: now}
+		old, ok := d.states[o.ID]
+		d.states[o.ID] = state
+		old.seen = now
+		if ok && old == state {
+			continue
+		}
+		result = append(result, o)
+	}
+	return result
+}
+
+// pruneStates forgets objects that weren't seen for a while
+func (d *webhookDispatcher) pruneStates() {
+	d.stateLock.Lock()
+	defer d.stateLock.Unlock()
+	for id, state := range d.states {
+		if time.Since(state.seen) > webhookStateTTL {
+			delete(d.states, id)
+		}
+	}
+}
+
+// run collects queued MapObjects of a subscriber and sends them in batches
+func (d *webhookDispatcher) run(s *webhookSubscriber) {
+	ticker := time.NewTicker(time.Duration(d.settings.WebhookFlushInterval) * time.Millisecond)
+	defer ticker.Stop()
+	batch := make([]opm.MapObject, 0, d.settings.WebhookBatchSize)
+	flush := func() {
+		if len(batch) > 0 {
+			d.send(s, batch)
+			batch = make([]opm.MapObject, 0, d.settings.WebhookBatchSize)
+		}
+	}
+	for {
+		select {
+		case o := <-s.queue:
+			batch = append(batch, o)
+			if len(batch) >= d.settings.WebhookBatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-s.quit:
+			// Send what is left
+			for len(s.queue) > 0 {
+				batch = append(batch, <-s.queue)
+			}
+			flush()
+			return
+		}
+	}
+}
+
+// send delivers a batch in the background, so retries don't hold up the queue of the subscriber.
+// When too many batches are pending, the batch goes to the dead letter file right away.
+func (d *webhookDispatcher) send(s *webhookSubscriber, objects []opm.MapObject) {
+	select {
+	case s.pending <- true:
+		go func() {
+			d.deliver(s.key, objects)
+			<-s.pending
+		}()
+	default:
+		apiMetrics.WebhooksFailedPerMinute.Incr(1)
+		body, _ := json.Marshal(opm.WebhookPayload{MapObjects: objects})
+		log.Printf("Webhook for %s failed: too many pending deliveries", s.key.Name)
+		d.deadLetters.Printf("%s\t%s\t%s\t%s", s.key.PublicKey, s.key.URL, "too many pending deliveries", body)
+	}
+}
+
+// deliver sends a batch of MapObjects and retries with exponential backoff.
+// Batches that can't be delivered end up in the dead letter file.
+func (d *webhookDispatcher) deliver(key opm.APIKey, objects []opm.MapObject) {
+	body, err := json.Marshal(opm.WebhookPayload{MapObjects: objects})
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	backoff := time.Second
+	for attempt := 0; ; attempt++ {
+		err = d.post(key, body)
+		if err == nil {
+			apiMetrics.WebhooksSentPerMinute.Incr(1)
+			return
+		}
+		apiMetrics.WebhooksFailedPerMinute.Incr(1)
+		if attempt >= d.settings.WebhookRetries {
+			break
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+	log.Printf("Webhook for %s failed: %s", key.Name, err)
+	d.deadLetters.Printf("%s\t%s\t%s\t%s", key.PublicKey, key.URL, err, body)
+}
+
+// post sends a single signed webhook request
+func (d *webhookDispatcher) post(key opm.APIKey, body []byte) error {
+	signingKey, err := key.SigningKey(opmSettings.Secret)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", key.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	timestamp := time.Now().Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(opm.TimestampHeader, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(opm.SignatureHeader, opm.Sign(signingKey, timestamp, body))
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("Webhook returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// matches checks if a MapObject passes the filter of the subscriber
+func (s *webhookSubscriber) matches(o opm.MapObject) bool {
+	f := s.key.Filter
+	if len(f.Types) > 0 && !containsInt(f.Types, o.Type) {
+		return false
+	}
+	if len(f.PokemonIDs) > 0 && o.Type == opm.POKEMON && !containsInt(f.PokemonIDs, o.PokemonID) {
+		return false
+	}
+	if len(f.Geofence) > 2 && !util.InPolygon(o.Lat, o.Lng, f.Geofence) {
+		return false
+	}
+	return true
+}
+
+func containsInt(list []int, value int) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
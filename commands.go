@@ -0,0 +1,283 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pogointel/opm/db"
+	"github.com/pogointel/opm/opm"
+	"github.com/pogointel/opm/util"
+)
+
+// commands are the subcommands of opm (opm <command> <action> [arguments])
+var commands = map[string]func(*db.OpenMapDb, []string) error{
+	"blacklist": blacklistCommand,
+	"keys":      keysCommand,
+	"regions":   regionsCommand,
+}
+
+// runCommand connects to the database and runs a subcommand
+func runCommand(settings opm.Settings, name string, args []string) {
+	command, ok := commands[name]
+	if !ok {
+		fmt.Printf("Unknown command: %s\n", name)
+		os.Exit(2)
+	}
+	database, err := db.NewOpenMapDb(settings.DbName, settings.DbHost, settings.DbUser, settings.DbPassword)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	err = command(database, args)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+}
+
+func blacklistCommand(database *db.OpenMapDb, args []string) error {
+	usage := fmt.Errorf("Usage: opm blacklist list | add [-allow] [-reason text] [-expires 24h] <ip/cidr> | remove <ip/cidr>")
+	if len(args) == 0 {
+		return usage
+	}
+	flags := flag.NewFlagSet("blacklist", flag.ExitOnError)
+	allow := flags.Bool("allow", false, "Add to the allowlist instead of the blacklist")
+	reason := flags.String("reason", "", "Reason for the entry")
+	expires := flags.Duration("expires", 0, "Time until the entry expires (0 for never)")
+	flags.Parse(args[1:])
+
+	switch args[0] {
+	case "list":
+		entries, err := database.GetBlacklist()
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			kind := "block"
+			if e.Allow {
+				kind = "allow"
+			}
+			expiry := "never"
+			if e.Expiry != 0 {
+				expiry = time.Unix(e.Expiry, 0).Format(time.RFC3339)
+			}
+			fmt.Printf("%-5s %-20s %-25s %s\n", kind, e.CIDR, expiry, e.Reason)
+		}
+	case "add":
+		if flags.NArg() != 1 {
+			return usage
+		}
+		n, err := util.ParseCIDR(flags.Arg(0))
+		if err != nil {
+			return err
+		}
+		entry := opm.BlacklistEntry{CIDR: n.String(), Allow: *allow, Reason: *reason, Added: time.Now().Unix()}
+		if *expires > 0 {
+			entry.Expiry = time.Now().Add(*expires).Unix()
+		}
+		err = database.AddBlacklistEntry(entry)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Added %s\n", entry.CIDR)
+	case "remove":
+		if flags.NArg() != 1 {
+			return usage
+		}
+		n, err := util.ParseCIDR(flags.Arg(0))
+		if err != nil {
+			return err
+		}
+		err = database.RemoveBlacklistEntry(n.String())
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Removed %s\n", n.String())
+	default:
+		return usage
+	}
+	return nil
+}
+
+func keysCommand(database *db.OpenMapDb, args []string) error {
+	usage := fmt.Errorf("Usage: opm keys usage [-day YYYY-MM-DD] [-month YYYY-MM] | scopes <scope,scope,...> <key> | quota [-daily n] [-monthly n] <key>")
+	if len(args) == 0 {
+		return usage
+	}
+	today, thisMonth := opm.UsagePeriods(time.Now())
+	flags := flag.NewFlagSet("keys", flag.ExitOnError)
+	day := flags.String("day", today, "Day for the usage report")
+	month := flags.String("month", thisMonth, "Month for the usage report")
+	daily := flags.Int("daily", 0, "Requests per day (0 for unlimited)")
+	monthly := flags.Int("monthly", 0, "Requests per month (0 for unlimited)")
+	flags.Parse(args[1:])
+
+	switch args[0] {
+	case "usage":
+		keys, err := database.GetAPIKeys()
+		if err != nil {
+			return err
+		}
+		dayUsage, err := usageByKey(database, *day)
+		if err != nil {
+			return err
+		}
+		monthUsage, err := usageByKey(database, *month)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%-20s %-20s %-20s %s\n", "Name", *day, *month, "Scopes")
+		for _, k := range keys {
+			scopes := strings.Join(k.Scopes, ",")
+			if scopes == "" {
+				scopes = opm.ScopeSubmit
+			}
+			fmt.Printf("%-20s %-20s %-20s %s\n", k.Name, formatUsage(dayUsage[k.PublicKey], k.DailyQuota),
+				formatUsage(monthUsage[k.PublicKey], k.MonthlyQuota), scopes)
+		}
+		return nil
+	case "scopes":
+		if flags.NArg() != 2 {
+			return usage
+		}
+		key, err := database.GetAPIKey(flags.Arg(1))
+		if err != nil {
+			return err
+		}
+		key.Scopes = nil
+		for _, scope := range strings.Split(flags.Arg(0), ",") {
+			if !opm.IsScope(scope) {
+				return fmt.Errorf("Unknown scope: %s", scope)
+			}
+			key.Scopes = append(key.Scopes, scope)
+		}
+		return database.UpdateAPIKey(key)
+	case "quota":
+		if flags.NArg() != 1 {
+			return usage
+		}
+		key, err := database.GetAPIKey(flags.Arg(0))
+		if err != nil {
+			return err
+		}
+		key.DailyQuota = *daily
+		key.MonthlyQuota = *monthly
+		return database.UpdateAPIKey(key)
+	}
+	return usage
+}
+
+// usageByKey returns the request counts of all keys for a period
+func usageByKey(database *db.OpenMapDb, period string) (map[string]int, error) {
+	usage, err := database.GetUsageForPeriod(period)
+	if err != nil {
+		return nil, err
+	}
+	counts := make(map[string]int)
+	for _, u := range usage {
+		counts[u.PublicKey] = u.Count
+	}
+	return counts, nil
+}
+
+func formatUsage(count, quota int) string {
+	if quota <= 0 {
+		return fmt.Sprintf("%d", count)
+	}
+	return fmt.Sprintf("%d/%d", count, quota)
+}
+
+func regionsCommand(database *db.OpenMapDb, args []string) error {
+	usage := fmt.Errorf("Usage: opm regions list <key> | add -name <name> (-circle lat,lng,radius | -polygon lat,lng;lat,lng;...) <key> | remove -name <name> <key> | clear <key>")
+	if len(args) == 0 {
+		return usage
+	}
+	flags := flag.NewFlagSet("regions", flag.ExitOnError)
+	name := flags.String("name", "", "Name of the region")
+	circle := flags.String("circle", "", "Circle as lat,lng,radius (radius in meters)")
+	polygon := flags.String("polygon", "", "Polygon as lat,lng;lat,lng;...")
+	flags.Parse(args[1:])
+	if flags.NArg() != 1 {
+		return usage
+	}
+	key, err := database.GetAPIKey(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "list":
+		if len(key.Regions) == 0 {
+			fmt.Println("No regions (submissions are accepted anywhere)")
+		}
+		for _, r := range key.Regions {
+			if len(r.Polygon) > 0 {
+				fmt.Printf("%-20s polygon with %d points\n", r.Name, len(r.Polygon))
+			} else {
+				fmt.Printf("%-20s circle (%f,%f) %.0fm\n", r.Name, r.Center.Lat, r.Center.Lng, r.Radius)
+			}
+		}
+		return nil
+	case "add":
+		if *name == "" || (*circle == "") == (*polygon == "") {
+			return usage
+		}
+		region := opm.Region{Name: *name}
+		if *circle != "" {
+			values, err := parseFloats(*circle, ",")
+			if err != nil || len(values) != 3 {
+				return fmt.Errorf("Invalid circle: %s", *circle)
+			}
+			region.Center = opm.Coordinates{Lat: values[0], Lng: values[1]}
+			region.Radius = values[2]
+		} else {
+			for _, p := range strings.Split(*polygon, ";") {
+				values, err := parseFloats(p, ",")
+				if err != nil || len(values) != 2 {
+					return fmt.Errorf("Invalid point: %s", p)
+				}
+				region.Polygon = append(region.Polygon, opm.Coordinates{Lat: values[0], Lng: values[1]})
+			}
+			if len(region.Polygon) < 3 {
+				return fmt.Errorf("A polygon needs at least 3 points")
+			}
+		}
+		key.Regions = append(removeRegion(key.Regions, *name), region)
+	case "remove":
+		if *name == "" {
+			return usage
+		}
+		key.Regions = removeRegion(key.Regions, *name)
+	case "clear":
+		key.Regions = nil
+	default:
+		return usage
+	}
+	return database.UpdateAPIKey(key)
+}
+
+func removeRegion(regions []opm.Region, name string) []opm.Region {
+	result := make([]opm.Region, 0, len(regions))
+	for _, r := range regions {
+		if r.Name != name {
+			result = append(result, r)
+		}
+	}
+	return result
+}
+
+func parseFloats(s, sep string) ([]float64, error) {
+	var values []float64
+	for _, v := range strings.Split(s, sep) {
+		f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, f)
+	}
+	return values, nil
+}
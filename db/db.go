@@ -2,6 +2,7 @@ package db
 
 import (
 	"log"
+	"strings"
 	"time"
 
 	"github.com/pogointel/opm/opm"
@@ -69,14 +70,31 @@ func (db *OpenMapDb) ensureIndex() error {
 	if err != nil {
 		return err
 	}
-	err = db.mongoSession.DB(db.DbName).C("Keys").EnsureIndex(mgo.Index{Key: []string{"privatekey"}, Unique: true, DropDups: true})
-	if err != nil {
+	// Private keys are only stored as hashes now, so the plaintext field is empty for most keys
+	err = db.mongoSession.DB(db.DbName).C("Keys").DropIndex("privatekey")
+	if err != nil && !strings.Contains(err.Error(), "not found") {
 		return err
 	}
 	err = db.mongoSession.DB(db.DbName).C("Keys").EnsureIndex(mgo.Index{Key: []string{"publickey"}, Unique: true, DropDups: true})
 	if err != nil {
 		return err
 	}
+	err = db.mongoSession.DB(db.DbName).C("Usage").EnsureIndex(mgo.Index{Key: []string{"publickey", "period"}, Unique: true, DropDups: true})
+	if err != nil {
+		return err
+	}
+	err = db.mongoSession.DB(db.DbName).C("Blacklist").EnsureIndex(mgo.Index{Key: []string{"cidr"}, Unique: true, DropDups: true})
+	if err != nil {
+		return err
+	}
+	err = db.mongoSession.DB(db.DbName).C("Spawnpoints").EnsureIndex(mgo.Index{Key: []string{"id"}, Unique: true, DropDups: true})
+	if err != nil {
+		return err
+	}
+	err = db.mongoSession.DB(db.DbName).C("SpawnCoverage").EnsureIndex(mgo.Index{Key: []string{"day", "spawnpointid"}, Unique: true, DropDups: true})
+	if err != nil {
+		return err
+	}
 	return db.mongoSession.DB(db.DbName).C("Proxy").EnsureIndex(mgo.Index{Key: []string{"id"}, Unique: true, DropDups: true})
 }
 
@@ -227,6 +245,7 @@ func (db *OpenMapDb) AddMapObject(m opm.MapObject) {
 			Coordinates: []float64{m.Lng, m.Lat},
 		},
 		Expiry: m.Expiry,
+		Lured:  m.Lured,
 		Team:   m.Team,
 		Source: m.Source,
 	}
@@ -243,8 +262,42 @@ func (db *OpenMapDb) AddMapObjects(m []opm.MapObject) {
 	}
 }
 
-// GetMapObjects returns all objects within a radius (in meters) of the given lat/lng
-func (db *OpenMapDb) GetMapObjects(lat, lng float64, types []int, radius int) ([]opm.MapObject, error) {
+// GetMapObjects returns all objects around the given lat/lng that match the filter
+func (db *OpenMapDb) GetMapObjects(lat, lng float64, filter opm.MapObjectFilter) ([]opm.MapObject, error) {
+	now := time.Now().Unix()
+	// Conditions per type
+	var types []bson.M
+	for _, t := range filter.Types {
+		c := bson.M{"type": t}
+		switch t {
+		case opm.POKEMON:
+			c["expiry"] = bson.M{"$gt": now + filter.MinTimeLeft}
+			ids := bson.M{}
+			if len(filter.PokemonIDs) > 0 {
+				ids["$in"] = filter.PokemonIDs
+			}
+			if len(filter.ExcludePokemonIDs) > 0 {
+				ids["$nin"] = filter.ExcludePokemonIDs
+			}
+			if len(ids) > 0 {
+				c["pokemonid"] = ids
+			}
+		case opm.POKESTOP:
+			if filter.LuredOnly {
+				c["lured"] = true
+			}
+			c["$or"] = []bson.M{{"expiry": bson.M{"$gt": now}}, {"expiry": 0}}
+		case opm.GYM:
+			if len(filter.Teams) > 0 {
+				c["team"] = bson.M{"$in": filter.Teams}
+			}
+			c["$or"] = []bson.M{{"expiry": bson.M{"$gt": now}}, {"expiry": 0}}
+		}
+		types = append(types, c)
+	}
+	if len(types) == 0 {
+		return []opm.MapObject{}, nil
+	}
 	// Build query
 	q := bson.M{
 		"loc": bson.M{
@@ -252,18 +305,22 @@ func (db *OpenMapDb) GetMapObjects(lat, lng float64, types []int, radius int) ([
 				"$geometry": bson.M{
 					"type":        "Point",
 					"coordinates": []float64{lng, lat}},
-				"$maxDistance": radius,
+				"$maxDistance": filter.Radius,
 			},
 		},
-		"$or": []bson.M{
-			{"expiry": bson.M{"$gt": time.Now().Unix()}},
-			{"expiry": 0},
-		},
-		"type": bson.M{"$in": types},
+		"$or": types,
+	}
+	query := db.mongoSession.DB(db.DbName).C("Objects").Find(q)
+	// $near already sorts by distance
+	if filter.Sort == opm.SortExpiry {
+		query = query.Sort("expiry")
+	}
+	if filter.Limit > 0 {
+		query = query.Limit(filter.Limit)
 	}
 	// Query db
 	var objects []object
-	err := db.mongoSession.DB(db.DbName).C("Objects").Find(q).All(&objects)
+	err := query.All(&objects)
 	if err != nil {
 		return nil, err
 	}
@@ -272,13 +329,15 @@ func (db *OpenMapDb) GetMapObjects(lat, lng float64, types []int, radius int) ([
 	for i, o := range objects {
 		// Cast coordinates
 		mapObjects[i] = opm.MapObject{
-			Type:      o.Type,
-			PokemonID: o.PokemonID,
-			ID:        o.ID,
-			Lat:       o.Loc.Coordinates[1],
-			Lng:       o.Loc.Coordinates[0],
-			Expiry:    o.Expiry,
-			Team:      o.Team,
+			Type:         o.Type,
+			PokemonID:    o.PokemonID,
+			SpawnpointID: o.SpawnpointID,
+			ID:           o.ID,
+			Lat:          o.Loc.Coordinates[1],
+			Lng:          o.Loc.Coordinates[0],
+			Expiry:       o.Expiry,
+			Lured:        o.Lured,
+			Team:         o.Team,
 		}
 	}
 	return mapObjects, nil
@@ -456,12 +515,74 @@ func (db *OpenMapDb) AddAPIKey(k opm.APIKey) error {
 
 func (db *OpenMapDb) GetAPIKey(k string) (opm.APIKey, error) {
 	var key opm.APIKey
-	err := db.mongoSession.DB(db.DbName).C("Keys").Find(bson.M{"key": k}).One(&key)
+	err := db.mongoSession.DB(db.DbName).C("Keys").Find(bson.M{"publickey": k}).One(&key)
 	return key, err
 }
 
+// GetAPIKeys returns all API keys from the db
+func (db *OpenMapDb) GetAPIKeys() ([]opm.APIKey, error) {
+	var keys []opm.APIKey
+	err := db.mongoSession.DB(db.DbName).C("Keys").Find(nil).All(&keys)
+	return keys, err
+}
+
 func (db *OpenMapDb) UpdateAPIKey(k opm.APIKey) error {
-	return db.mongoSession.DB(db.DbName).C("Keys").Update(bson.M{"key": k.PublicKey}, k)
+	return db.mongoSession.DB(db.DbName).C("Keys").Update(bson.M{"publickey": k.PublicKey}, k)
+}
+
+// UpdateReputation stores the reputation of a key, unless it was reset since the previous update.
+// Only the reputation is written, so concurrent changes of the key are kept.
+func (db *OpenMapDb) UpdateReputation(publicKey string, previous int64, r opm.Reputation) error {
+	err := db.mongoSession.DB(db.DbName).C("Keys").Update(bson.M{"publickey": publicKey, "reputation.updated": previous}, bson.M{"$set": bson.M{"reputation": r}})
+	if err == mgo.ErrNotFound {
+		return nil
+	}
+	return err
+}
+
+// SetAPIKeyStatus enables, disables or quarantines a key without touching its other fields
+func (db *OpenMapDb) SetAPIKeyStatus(publicKey string, enabled, quarantined bool, reason string) error {
+	update := bson.M{"$set": bson.M{"enabled": enabled, "quarantined": quarantined, "disabledreason": reason}}
+	return db.mongoSession.DB(db.DbName).C("Keys").Update(bson.M{"publickey": publicKey}, update)
+}
+
+// DeleteAPIKey removes an API key and its usage counters
+func (db *OpenMapDb) DeleteAPIKey(publicKey string) error {
+	err := db.mongoSession.DB(db.DbName).C("Keys").Remove(bson.M{"publickey": publicKey})
+	if err != nil {
+		return err
+	}
+	_, err = db.mongoSession.DB(db.DbName).C("Usage").RemoveAll(bson.M{"publickey": publicKey})
+	return err
+}
+
+// SealPrivateKeys replaces the plaintext private keys and unsealed hashes of old API keys with sealed hashes
+func (db *OpenMapDb) SealPrivateKeys(secret string) (int, error) {
+	var keys []opm.APIKey
+	unsealed := bson.M{"$or": []bson.M{
+		{"privatekey": bson.M{"$nin": []interface{}{"", nil}}},
+		{"privatekeyhash": bson.M{"$nin": []interface{}{"", nil}}},
+	}}
+	err := db.mongoSession.DB(db.DbName).C("Keys").Find(unsealed).All(&keys)
+	if err != nil {
+		return 0, err
+	}
+	for _, k := range keys {
+		signingKey, err := k.SigningKey(secret)
+		if err != nil {
+			return 0, err
+		}
+		sealed, err := opm.SealKey(secret, signingKey)
+		if err != nil {
+			return 0, err
+		}
+		update := bson.M{"$set": bson.M{"sealedkey": sealed, "privatekey": "", "privatekeyhash": ""}}
+		err = db.mongoSession.DB(db.DbName).C("Keys").Update(bson.M{"publickey": k.PublicKey}, update)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(keys), nil
 }
 
 func (db *OpenMapDb) APIKeyStats() map[string]int {
@@ -480,3 +601,142 @@ func (db *OpenMapDb) APIKeyStats() map[string]int {
 	// Return result
 	return result
 }
+
+// GetBlacklist returns all blacklist/allowlist entries that are not expired
+func (db *OpenMapDb) GetBlacklist() ([]opm.BlacklistEntry, error) {
+	var entries []opm.BlacklistEntry
+	q := bson.M{
+		"$or": []bson.M{
+			{"expiry": bson.M{"$gt": time.Now().Unix()}},
+			{"expiry": 0},
+		},
+	}
+	err := db.mongoSession.DB(db.DbName).C("Blacklist").Find(q).All(&entries)
+	return entries, err
+}
+
+// AddBlacklistEntry adds an entry to the blacklist or replaces the existing entry for the same CIDR
+func (db *OpenMapDb) AddBlacklistEntry(e opm.BlacklistEntry) error {
+	_, err := db.mongoSession.DB(db.DbName).C("Blacklist").Upsert(bson.M{"cidr": e.CIDR}, e)
+	return err
+}
+
+// RemoveBlacklistEntry removes the entry for a CIDR from the blacklist
+func (db *OpenMapDb) RemoveBlacklistEntry(cidr string) error {
+	return db.mongoSession.DB(db.DbName).C("Blacklist").Remove(bson.M{"cidr": cidr})
+}
+
+// RemoveExpiredBlacklistEntries removes all expired entries from the blacklist
+func (db *OpenMapDb) RemoveExpiredBlacklistEntries() (int, error) {
+	change, err := db.mongoSession.DB(db.DbName).C("Blacklist").RemoveAll(bson.M{"expiry": bson.M{"$gt": 0, "$lte": time.Now().Unix()}})
+	if err != nil {
+		return 0, err
+	}
+	return change.Removed, nil
+}
+
+// GetUsage returns the number of requests of an API key in a period
+func (db *OpenMapDb) GetUsage(publicKey, period string) (int, error) {
+	var u opm.Usage
+	err := db.mongoSession.DB(db.DbName).C("Usage").Find(bson.M{"publickey": publicKey, "period": period}).One(&u)
+	if err == mgo.ErrNotFound {
+		return 0, nil
+	}
+	return u.Count, err
+}
+
+// IncrementUsage adds n requests to the usage of an API key in a period
+func (db *OpenMapDb) IncrementUsage(publicKey, period string, n int) error {
+	_, err := db.mongoSession.DB(db.DbName).C("Usage").Upsert(bson.M{"publickey": publicKey, "period": period}, bson.M{"$inc": bson.M{"count": n}})
+	return err
+}
+
+// GetUsageForPeriod returns the usage of all API keys in a period
+func (db *OpenMapDb) GetUsageForPeriod(period string) ([]opm.Usage, error) {
+	var usage []opm.Usage
+	err := db.mongoSession.DB(db.DbName).C("Usage").Find(bson.M{"period": period}).All(&usage)
+	return usage, err
+}
+
+// AddScanJob stores a new scan job
+func (db *OpenMapDb) AddScanJob(j opm.ScanJob) error {
+	return db.mongoSession.DB(db.DbName).C("ScanJobs").Insert(j)
+}
+
+// UpdateScanJob replaces a scan job
+func (db *OpenMapDb) UpdateScanJob(j opm.ScanJob) error {
+	return db.mongoSession.DB(db.DbName).C("ScanJobs").Update(bson.M{"id": j.ID}, j)
+}
+
+// GetScanJob returns a scan job by its id
+func (db *OpenMapDb) GetScanJob(id string) (opm.ScanJob, error) {
+	var j opm.ScanJob
+	err := db.mongoSession.DB(db.DbName).C("ScanJobs").Find(bson.M{"id": id}).One(&j)
+	return j, err
+}
+
+// GetUnfinishedScanJobs returns all queued and running scan jobs, oldest first
+func (db *OpenMapDb) GetUnfinishedScanJobs() ([]opm.ScanJob, error) {
+	var jobs []opm.ScanJob
+	err := db.mongoSession.DB(db.DbName).C("ScanJobs").Find(bson.M{"status": bson.M{"$in": []string{opm.ScanJobQueued, opm.ScanJobRunning}}}).Sort("created").All(&jobs)
+	return jobs, err
+}
+
+// RemoveOldScanJobs removes all scan jobs that were created before the given unix timestamp
+func (db *OpenMapDb) RemoveOldScanJobs(before int64) (int, error) {
+	info, err := db.mongoSession.DB(db.DbName).C("ScanJobs").RemoveAll(bson.M{"created": bson.M{"$lt": before}})
+	if err != nil {
+		return 0, err
+	}
+	return info.Removed, nil
+}
+
+// SetScanArea adds or replaces a background scan area
+func (db *OpenMapDb) SetScanArea(a opm.ScanArea) error {
+	_, err := db.mongoSession.DB(db.DbName).C("ScanAreas").Upsert(bson.M{"name": a.Name}, a)
+	return err
+}
+
+// GetScanAreas returns all background scan areas
+func (db *OpenMapDb) GetScanAreas() ([]opm.ScanArea, error) {
+	var areas []opm.ScanArea
+	err := db.mongoSession.DB(db.DbName).C("ScanAreas").Find(nil).Sort("created").All(&areas)
+	return areas, err
+}
+
+// RemoveScanArea removes a background scan area
+func (db *OpenMapDb) RemoveScanArea(name string) error {
+	return db.mongoSession.DB(db.DbName).C("ScanAreas").Remove(bson.M{"name": name})
+}
+
+// UpdateSpawnpoint stores the location and despawn time of a spawnpoint and counts the sighting
+func (db *OpenMapDb) UpdateSpawnpoint(s opm.Spawnpoint) error {
+	_, err := db.mongoSession.DB(db.DbName).C("Spawnpoints").Upsert(bson.M{"id": s.ID}, bson.M{
+		"$set": bson.M{"lat": s.Lat, "lng": s.Lng, "despawnsecond": s.DespawnSecond, "updated": s.Updated},
+		"$inc": bson.M{"seen": 1},
+	})
+	return err
+}
+
+// GetSpawnpoints returns all spawnpoints inside the given bounds
+func (db *OpenMapDb) GetSpawnpoints(minLat, minLng, maxLat, maxLng float64) ([]opm.Spawnpoint, error) {
+	var spawnpoints []opm.Spawnpoint
+	err := db.mongoSession.DB(db.DbName).C("Spawnpoints").Find(bson.M{
+		"lat": bson.M{"$gte": minLat, "$lte": maxLat},
+		"lng": bson.M{"$gte": minLng, "$lte": maxLng},
+	}).All(&spawnpoints)
+	return spawnpoints, err
+}
+
+// AddSpawnCoverage adds expected and caught spawns of a spawnpoint to the coverage of the day
+func (db *OpenMapDb) AddSpawnCoverage(day, spawnpointID string, expected, caught int) error {
+	_, err := db.mongoSession.DB(db.DbName).C("SpawnCoverage").Upsert(bson.M{"day": day, "spawnpointid": spawnpointID}, bson.M{"$inc": bson.M{"expected": expected, "caught": caught}})
+	return err
+}
+
+// GetSpawnCoverage returns the coverage of all spawnpoints on a day
+func (db *OpenMapDb) GetSpawnCoverage(day string) ([]opm.SpawnCoverage, error) {
+	var coverage []opm.SpawnCoverage
+	err := db.mongoSession.DB(db.DbName).C("SpawnCoverage").Find(bson.M{"day": day}).Sort("spawnpointid").All(&coverage)
+	return coverage, err
+}
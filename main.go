@@ -8,6 +8,7 @@ import (
 	"log"
 	"math/rand"
 	"net/http"
+	"os"
 	"strings"
 	"time"
 
@@ -22,6 +23,11 @@ func init() {
 func main() {
 	// Settings
 	opmSettings, err := opm.LoadSettings("")
+	// Subcommands
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		runCommand(opmSettings, os.Args[1], os.Args[2:])
+		return
+	}
 	// Flags
 	// DB
 	dbHost := flag.String("dbhost", opmSettings.DbHost, "Host of the database")
@@ -37,7 +43,7 @@ func main() {
 	cleanAccounts := flag.Bool("cleanaccounts", false, "Marks all accounts as unused")
 	ufs := flag.Bool("ufs", false, "Update database from status")
 	statusPage := flag.String("statuspage", "http://localhost:8000/s", "Status page to use with -ufs and -status flags")
-	secret := flag.String("secret", opmSettings.Secret, "Secret for the status page")
+	secret := flag.String("secret", opmSettings.Secret, "Secret for the status page and API keys")
 	status := flag.Bool("status", false, "Show status")
 	removeDeadProxies := flag.Bool("removedeadproxies", false, "Remove all dead proxies from the database")
 	addPokemon := flag.Bool("addpokemon", false, "Adds a pokemon to the database. Use with -id, -lat and -lng")
@@ -53,7 +59,7 @@ func main() {
 	setName := flag.String("setname", "", "Sets the name for an API key")
 	setURL := flag.String("seturl", "", "Sets the URL for an API key")
 	keyStats := flag.Bool("keystats", false, "Shows stats for API keys")
-	genKey := flag.Bool("genkey", false, "Generate a new API Key")
+	genKey := flag.Bool("genkey", false, "Generate a new API Key. Use -setname and -seturl to skip the prompts")
 	// Parse flags
 	flag.Parse()
 	// Do something
@@ -66,33 +72,31 @@ func main() {
 	// API key stuff
 	// Generate Key
 	if *genKey {
-		var name string
-		var URL string
+		name := *setName
+		URL := *setURL
 		// Get data
-		fmt.Print("Enter name: ")
-		fmt.Scanln(&name)
-		fmt.Print("Enter URL: ")
-		fmt.Scanln(&URL)
-
-		private := generateRandomKey()
-		public := generateRandomKey()
-
-		fmt.Printf("%s\t\t%s\n", private, public)
-
-		key := opm.APIKey{
-			PrivateKey: private,
-			PublicKey:  public,
-			Name:       name,
-			URL:        URL,
-			Enabled:    true,
-			Verified:   false,
+		if name == "" {
+			fmt.Print("Enter name: ")
+			fmt.Scanln(&name)
+		}
+		if URL == "" {
+			fmt.Print("Enter URL: ")
+			fmt.Scanln(&URL)
 		}
 
-		err := database.AddAPIKey(key)
+		if *secret == "" {
+			fmt.Println("Warning: no secret configured (-secret). The hash of the private key is stored unsealed.")
+		}
+		key, private, err := opm.NewAPIKey(name, URL, *secret)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		err = database.AddAPIKey(key)
 		if err != nil {
 			fmt.Println(err)
 		} else {
-			fmt.Printf("\nGenerated API key\n\tPrivate:\t%s\n\tPublic:\t\t%s\nThe key is enabled, but not verified!\n", key.PrivateKey, key.PublicKey)
+			fmt.Printf("\nGenerated API key\n\tPrivate:\t%s\n\tPublic:\t\t%s\nThe key is enabled, but not verified!\nOnly a hash of the private key is stored, it can't be shown again.\n", private, key.PublicKey)
 		}
 	}
 	// stats
@@ -114,8 +118,8 @@ func main() {
 		if err != nil {
 			fmt.Println(err)
 		} else {
-			if !k.Enabled {
-				k.Enabled = true
+			if !k.Enabled || k.Quarantined {
+				k.Reenable()
 				database.UpdateAPIKey(k)
 			} else {
 				fmt.Println("Key already enabled")
@@ -326,13 +330,3 @@ func main() {
 	}
 
 }
-
-func generateRandomKey() string {
-	var letterRunes = []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789")
-	b := make([]rune, 8)
-	for i := range b {
-		b[i] = letterRunes[rand.Intn(len(letterRunes))]
-	}
-	key := string(b)
-	return key
-}
@@ -8,6 +8,18 @@ var ErrWrongMethod = errors.New("Wrong method")
 var ErrNoProxiesAvailable = errors.New("No proxy available.")
 var ErrProxyNotFound = errors.New("Proxy not found")
 var ErrTimeout = errors.New("Timeout")
+var ErrQueueClosed = errors.New("Queue closed")
 var ErrInvalidWebhook = errors.New("Invalid webhook")
 var ErrPokemonExpired = errors.New("Pokemon already expired")
 var ErrPokemonFuture = errors.New("Pokemons disappear time too far in the future")
+var ErrOutOfRegion = errors.New("Location outside of the allowed regions")
+var ErrKeyNotFound = errors.New("Key not found")
+var ErrKeyDisabled = errors.New("Key disabled")
+var ErrInvalidKey = errors.New("Invalid key")
+var ErrNoSecret = errors.New("No secret configured")
+var ErrMissingScope = errors.New("Key is not allowed to use this endpoint")
+var ErrKeyRequired = errors.New("An API key is required for this endpoint")
+var ErrQuotaExceeded = errors.New("Quota exceeded")
+var ErrRateLimited = errors.New("Rate limit exceeded")
+var ErrTooManyJobs = errors.New("Too many scan jobs")
+var ErrInvalidFilter = errors.New("Invalid filter")
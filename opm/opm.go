@@ -1,5 +1,7 @@
 package opm
 
+import "time"
+
 // MapObject types
 const (
 	POKEMON  = 1
@@ -33,6 +35,77 @@ type APIResponse struct {
 	Ok         bool
 	Error      string
 	MapObjects []MapObject
+	FreshAsOf  int64 `json:",omitempty"` // Time of the scan, if the result was shared with other requests
+	// Scan queue
+	QueuePosition int `json:",omitempty"` // Position in the scan queue when the request arrived
+	EstimatedWait int `json:",omitempty"` // Estimated time in the scan queue in seconds
+}
+
+// Scan job states
+const (
+	ScanJobQueued  = "queued"
+	ScanJobRunning = "running"
+	ScanJobDone    = "done"
+	ScanJobFailed  = "failed"
+)
+
+// ScanJob is an asynchronous scan of one or more locations around Lat/Lng
+type ScanJob struct {
+	ID         string      `json:"id"`
+	Status     string      `json:"status"`
+	Lat        float64     `json:"lat"`
+	Lng        float64     `json:"lng"`
+	Radius     int         `json:"radius,omitempty"`
+	Points     int         `json:"points"` // Number of locations to scan
+	Done       int         `json:"done"`   // Number of scanned locations
+	Error      string      `json:"error,omitempty"`
+	MapObjects []MapObject `json:"objects"`
+	Client     string      `json:"-"` // Address of the client that created the job
+	Created    int64       `json:"created"`
+	Started    int64       `json:"started,omitempty"`
+	Finished   int64       `json:"finished,omitempty"`
+}
+
+// Scan modes of ScanAreas
+const (
+	ScanAreaGrid        = "grid"        // Scan all locations of a hexagonal grid, one after another
+	ScanAreaSpawnpoints = "spawnpoints" // Scan known spawnpoints shortly after they spawn
+)
+
+// ScanArea is an area that is scanned continuously in the background
+type ScanArea struct {
+	Name    string  `json:"name"`
+	Region  Region  `json:"region"`
+	Mode    string  `json:"mode"`
+	Step    float64 `json:"step"` // Distance between scan locations in meters
+	Paused  bool    `json:"paused"`
+	Created int64   `json:"created"`
+}
+
+// SpawnDuration is the time a Pokemon stays at its spawnpoint in seconds
+const SpawnDuration = 900
+
+// Spawnpoint is a location where Pokemon spawn every hour
+type Spawnpoint struct {
+	ID            string  `json:"id"`
+	Lat           float64 `json:"lat"`
+	Lng           float64 `json:"lng"`
+	DespawnSecond int     `json:"despawn_second"` // Seconds after the full hour when the Pokemon disappears
+	Seen          int     `json:"seen"`           // Number of sightings
+	Updated       int64   `json:"updated"`
+}
+
+// SpawnSecond returns the seconds after the full hour when a Pokemon appears
+func (s Spawnpoint) SpawnSecond() int {
+	return (s.DespawnSecond - SpawnDuration + 3600) % 3600
+}
+
+// SpawnCoverage counts the expected and caught spawns of a spawnpoint on one day (2006-01-02)
+type SpawnCoverage struct {
+	Day          string `json:"day"`
+	SpawnpointID string `json:"spawnpoint"`
+	Expected     int    `json:"expected"`
+	Caught       int    `json:"caught"`
 }
 
 // MapObject represents an object on the map (Pokemon, Gym or Pokestop)
@@ -49,6 +122,60 @@ type MapObject struct {
 	Source       string  `json:"source,omitempty"`
 }
 
+// Sort orders for MapObjectFilter
+const (
+	SortDistance = "distance"
+	SortExpiry   = "expiry"
+)
+
+// MapObjectFilter selects MapObjects from the db
+type MapObjectFilter struct {
+	Types             []int  // MapObject types
+	PokemonIDs        []int  // Only these Pokemon. Empty means all.
+	ExcludePokemonIDs []int  // Not these Pokemon
+	MinTimeLeft       int64  // Minimum time (in seconds) until a Pokemon expires
+	Teams             []int  // Only gyms of these teams. Empty means all.
+	LuredOnly         bool   // Only pokestops with a lure
+	Radius            int    // Radius in meters
+	Limit             int    // Maximum number of objects, 0 for no limit
+	Sort              string // SortDistance (default) or SortExpiry (objects without expiry first)
+}
+
+// Matches checks if the object matches the filter (ignoring location, limit and sort order)
+func (f MapObjectFilter) Matches(o MapObject, now int64) bool {
+	if !containsInt(f.Types, o.Type) {
+		return false
+	}
+	switch o.Type {
+	case POKEMON:
+		if o.Expiry <= now+f.MinTimeLeft {
+			return false
+		}
+		if len(f.PokemonIDs) > 0 && !containsInt(f.PokemonIDs, o.PokemonID) {
+			return false
+		}
+		return !containsInt(f.ExcludePokemonIDs, o.PokemonID)
+	case POKESTOP:
+		if f.LuredOnly && !o.Lured {
+			return false
+		}
+	case GYM:
+		if len(f.Teams) > 0 && !containsInt(f.Teams, o.Team) {
+			return false
+		}
+	}
+	return o.Expiry == 0 || o.Expiry > now
+}
+
+func containsInt(list []int, v int) bool {
+	for _, i := range list {
+		if i == v {
+			return true
+		}
+	}
+	return false
+}
+
 // Pokemon represents a Pokemon MapObject
 type Pokemon struct {
 	EncounterID   string
@@ -83,10 +210,121 @@ type StatusEntry struct {
 
 // APIKey is used for for managing ingress/egress via API
 type APIKey struct {
-	PrivateKey string
-	PublicKey  string
-	Name       string
-	URL        string
-	Verified   bool
-	Enabled    bool
+	PrivateKey     string // Deprecated: plaintext private key of old keys, replaced by SealedKey
+	PrivateKeyHash string // Deprecated: unsealed hash of the private key, replaced by SealedKey
+	SealedKey      string // Hash of the private key, encrypted with the server secret (see SealKey)
+	PublicKey      string
+	Name           string
+	URL            string
+	Verified       bool
+	Enabled        bool
+	Filter         WebhookFilter
+	Regions        []Region // Areas the key can submit objects for. Empty means anywhere.
+	// Access
+	Scopes       []string // Empty means ScopeSubmit only
+	DailyQuota   int      // Maximum number of requests per day, 0 for unlimited
+	MonthlyQuota int      // Maximum number of requests per month, 0 for unlimited
+	// Reputation
+	Quarantined    bool   // Submissions are checked, but not stored
+	DisabledReason string // Why the key was disabled or quarantined
+	Reputation     Reputation
+}
+
+// Reenable enables the key again and starts over with a clean reputation
+func (k *APIKey) Reenable() {
+	k.Enabled = true
+	k.Quarantined = false
+	k.DisabledReason = ""
+	k.Reputation = Reputation{Updated: time.Now().Unix()}
+}
+
+// API key scopes
+const (
+	ScopeSubmit    = "submit"
+	ScopeCacheRead = "cache-read"
+	ScopeScan      = "scan"
+	ScopeAdmin     = "admin"
+)
+
+// IsScope checks if scope is a known API key scope
+func IsScope(scope string) bool {
+	switch scope {
+	case ScopeSubmit, ScopeCacheRead, ScopeScan, ScopeAdmin:
+		return true
+	}
+	return false
+}
+
+// HasScope checks if the key is allowed to use scope
+func (k APIKey) HasScope(scope string) bool {
+	if len(k.Scopes) == 0 {
+		return scope == ScopeSubmit
+	}
+	for _, s := range k.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// Usage is the number of requests of an APIKey in a period (day: 2006-01-02, month: 2006-01)
+type Usage struct {
+	PublicKey string
+	Period    string
+	Count     int
+}
+
+// UsagePeriods returns the day and month periods for t
+func UsagePeriods(t time.Time) (string, string) {
+	t = t.UTC()
+	return t.Format("2006-01-02"), t.Format("2006-01")
+}
+
+// Reputation tracks the quality of the submissions of an APIKey.
+// The counters decay over time, so old mistakes are forgiven eventually.
+type Reputation struct {
+	Submitted    float64 // All submitted objects
+	Invalid      float64 // Objects that failed validation
+	Expired      float64 // Pokemon that were already expired
+	Confirmed    float64 // Pokemon that were also seen by the scanner
+	Contradicted float64 // Pokemon that the scanner didn't see at the same place and time
+	Score        float64 // 0 (bad) to 1 (good)
+	Updated      int64   // Unix timestamp of the last update
+}
+
+// BlacklistEntry blocks or explicitly allows a range of client addresses
+type BlacklistEntry struct {
+	CIDR   string
+	Allow  bool // Allowlist entries take precedence over blacklist entries
+	Reason string
+	Added  int64
+	Expiry int64 // Unix timestamp, 0 if the entry doesn't expire
+}
+
+// Coordinates is a pair of latitude and longitude
+type Coordinates struct {
+	Lat float64 `json:"lat"`
+	Lng float64 `json:"lng"`
+}
+
+// Region is an area on the map. It is either a polygon or a circle around Center with Radius (in meters).
+type Region struct {
+	Name    string
+	Polygon []Coordinates `json:",omitempty"`
+	Center  Coordinates
+	Radius  float64
+}
+
+// WebhookFilter restricts the MapObjects that are sent to the URL of an APIKey.
+// Empty fields match everything.
+type WebhookFilter struct {
+	Types      []int         `json:"types,omitempty"`
+	PokemonIDs []int         `json:"pokemonIDs,omitempty"`
+	Geofence   []Coordinates `json:"geofence,omitempty"`
+}
+
+// WebhookPayload is the body of outgoing webhooks
+type WebhookPayload struct {
+	MapObjects []MapObject `json:"objects"`
 }
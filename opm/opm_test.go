@@ -0,0 +1,33 @@
+package opm
+
+import "testing"
+
+func TestMapObjectFilterMatches(t *testing.T) {
+	const now = 1000
+	all := []int{POKEMON, POKESTOP, GYM}
+	tests := []struct {
+		name   string
+		filter MapObjectFilter
+		object MapObject
+		want   bool
+	}{
+		{"type", MapObjectFilter{Types: []int{GYM}}, MapObject{Type: POKEMON, Expiry: now + 60}, false},
+		{"pokemon", MapObjectFilter{Types: all}, MapObject{Type: POKEMON, PokemonID: 1, Expiry: now + 60}, true},
+		{"expired pokemon", MapObjectFilter{Types: all}, MapObject{Type: POKEMON, Expiry: now}, false},
+		{"min time left", MapObjectFilter{Types: all, MinTimeLeft: 60}, MapObject{Type: POKEMON, Expiry: now + 60}, false},
+		{"enough time left", MapObjectFilter{Types: all, MinTimeLeft: 60}, MapObject{Type: POKEMON, Expiry: now + 61}, true},
+		{"pokemon id", MapObjectFilter{Types: all, PokemonIDs: []int{2, 3}}, MapObject{Type: POKEMON, PokemonID: 1, Expiry: now + 60}, false},
+		{"excluded pokemon", MapObjectFilter{Types: all, ExcludePokemonIDs: []int{1}}, MapObject{Type: POKEMON, PokemonID: 1, Expiry: now + 60}, false},
+		{"pokestop", MapObjectFilter{Types: all}, MapObject{Type: POKESTOP}, true},
+		{"lured only", MapObjectFilter{Types: all, LuredOnly: true}, MapObject{Type: POKESTOP}, false},
+		{"lured", MapObjectFilter{Types: all, LuredOnly: true}, MapObject{Type: POKESTOP, Lured: true}, true},
+		{"expired lure", MapObjectFilter{Types: all}, MapObject{Type: POKESTOP, Lured: true, Expiry: now - 1}, false},
+		{"team", MapObjectFilter{Types: all, Teams: []int{1}}, MapObject{Type: GYM, Team: 1}, true},
+		{"other team", MapObjectFilter{Types: all, Teams: []int{1}}, MapObject{Type: GYM, Team: 2}, false},
+	}
+	for _, test := range tests {
+		if got := test.filter.Matches(test.object, now); got != test.want {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
@@ -8,6 +8,8 @@ import (
 // DefaultSettings are the default value for Settings
 var DefaultSettings = Settings{
 	AllowOrigin:          "*",
+	TrustedProxies:       []string{"127.0.0.1", "::1"},
+	ClientIPHeaders:      []string{"CF-Connecting-IP", "X-Forwarded-For", "X-Real-IP"},
 	CacheRadius:          1000,
 	DbHost:               "localhost",
 	DbName:               "OPM",
@@ -26,8 +28,10 @@ var DefaultSettings = Settings{
 // Settings is a struct for storing OPM settings that are relevant for most packages
 type Settings struct {
 	// Security
-	Secret      string
-	AllowOrigin string
+	Secret          string
+	AllowOrigin     string
+	TrustedProxies  []string // IPs/CIDR ranges of proxies whose client IP headers are used (for scanners: also the apiserver host)
+	ClientIPHeaders []string // Headers with the client IP, in order of precedence
 	// General
 	CacheRadius int
 	// DB
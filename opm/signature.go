@@ -0,0 +1,151 @@
+package opm
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+)
+
+// Header names used for signed requests
+const (
+	SignatureHeader = "X-OPM-Signature"
+	TimestampHeader = "X-OPM-Timestamp"
+)
+
+// Sign returns the hex encoded HMAC-SHA256 of the timestamp and body using the provided secret
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// CheckSignature reports whether signature is a valid signature for timestamp and body
+func CheckSignature(secret string, timestamp int64, body []byte, signature string) bool {
+	expected := Sign(secret, timestamp, body)
+	return hmac.Equal([]byte(expected), []byte(signature))
+}
+
+// HashKey returns the hex encoded SHA-256 of a private key.
+// The hash is the secret for signing requests and webhooks, clients compute it from their private key.
+func HashKey(private string) string {
+	hash := sha256.Sum256([]byte(private))
+	return hex.EncodeToString(hash[:])
+}
+
+// keyCipher returns the AES-GCM cipher for the signing secrets of API keys, derived from the server secret
+func keyCipher(secret string) (cipher.AEAD, error) {
+	if secret == "" {
+		return nil, ErrNoSecret
+	}
+	key := sha256.Sum256([]byte("opm api keys." + secret))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// SealKey encrypts the signing secret of a key with the server secret.
+// The db only holds the sealed secret, so it can't be used for signing on its own.
+func SealKey(secret, signingKey string) (string, error) {
+	aead, err := keyCipher(secret)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(aead.Seal(nonce, nonce, []byte(signingKey), nil)), nil
+}
+
+// OpenKey decrypts a signing secret sealed with SealKey
+func OpenKey(secret, sealed string) (string, error) {
+	aead, err := keyCipher(secret)
+	if err != nil {
+		return "", err
+	}
+	b, err := hex.DecodeString(sealed)
+	if err != nil || len(b) < aead.NonceSize() {
+		return "", ErrInvalidKey
+	}
+	plain, err := aead.Open(nil, b[:aead.NonceSize()], b[aead.NonceSize():], nil)
+	if err != nil {
+		return "", ErrInvalidKey
+	}
+	return string(plain), nil
+}
+
+// GenerateKey returns a random hex encoded key of n bytes
+func GenerateKey(n int) (string, error) {
+	b := make([]byte, n)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// NewAPIKey creates a new enabled API key. The private key is only returned here,
+// the APIKey keeps its signing secret sealed with the server secret.
+func NewAPIKey(name, url, secret string) (APIKey, string, error) {
+	public, err := GenerateKey(8)
+	if err != nil {
+		return APIKey{}, "", err
+	}
+	key := APIKey{
+		PublicKey: public,
+		Name:      name,
+		URL:       url,
+		Enabled:   true,
+	}
+	private, err := key.Rotate(secret)
+	if err != nil {
+		return APIKey{}, "", err
+	}
+	return key, private, nil
+}
+
+// Rotate replaces the private key with a new one and returns it.
+// Without a server secret the hash of the private key is stored unsealed, until SealPrivateKeys seals it.
+func (k *APIKey) Rotate(secret string) (string, error) {
+	private, err := GenerateKey(32)
+	if err != nil {
+		return "", err
+	}
+	if secret == "" {
+		k.PrivateKey = ""
+		k.PrivateKeyHash = HashKey(private)
+		k.SealedKey = ""
+		return private, nil
+	}
+	sealed, err := SealKey(secret, HashKey(private))
+	if err != nil {
+		return "", err
+	}
+	k.PrivateKey = ""
+	k.PrivateKeyHash = ""
+	k.SealedKey = sealed
+	return private, nil
+}
+
+// SigningKey returns the secret for signing requests and webhooks of the key (the hash of the private key).
+// Keys that weren't sealed yet still work with their old fields.
+func (k APIKey) SigningKey(secret string) (string, error) {
+	switch {
+	case k.SealedKey != "":
+		return OpenKey(secret, k.SealedKey)
+	case k.PrivateKeyHash != "":
+		return k.PrivateKeyHash, nil
+	case k.PrivateKey != "":
+		return HashKey(k.PrivateKey), nil
+	}
+	return "", ErrInvalidKey
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/kellydunn/golang-geo"
+	"github.com/pogointel/opm/opm"
+)
+
+// pendingScan is a scan that is in progress or finished recently
+type pendingScan struct {
+	point    *geo.Point
+	started  time.Time
+	done     chan struct{}
+	response opm.APIResponse
+}
+
+// scanCoalescer merges scan requests for nearby locations.
+// Requests near a running scan wait for its result, requests near a recent scan get the objects from the db.
+// Only the requests of one scanner are merged. With several scanners behind the apiserver, nearby requests
+// that are sent to different scanners are scanned by each of them.
+type scanCoalescer struct {
+	lock     sync.Mutex
+	scans    []*pendingScan
+	distance float64       // Maximum distance between merged requests in meters
+	window   time.Duration // Time a finished scan is reused
+	radius   int           // Radius for answering from the db in meters
+	scan     func(lat, lng float64, client string) opm.APIResponse
+}
+
+func newScanCoalescer(s settings, scan func(lat, lng float64, client string) opm.APIResponse) *scanCoalescer {
+	return &scanCoalescer{
+		distance: float64(s.CoalesceDistance),
+		window:   time.Duration(s.CoalesceWindow) * time.Second,
+		radius:   s.CoalesceRadius,
+		scan:     scan,
+	}
+}
+
+// Scan returns the result of a scan at lat/lng for client, a running scan nearby or the db
+func (c *scanCoalescer) Scan(lat, lng float64, client string) opm.APIResponse {
+	if c.distance <= 0 {
+		return c.scan(lat, lng, client)
+	}
+	point := geo.NewPoint(lat, lng)
+	now := time.Now()
+	c.lock.Lock()
+	// Forget old scans
+	scans := c.scans[:0]
+	for _, s := range c.scans {
+		if !s.finished() || now.Sub(s.started) <= c.window {
+			scans = append(scans, s)
+		}
+	}
+	c.scans = scans
+	// Find a scan nearby
+	var nearby *pendingScan
+	for _, s := range c.scans {
+		if point.GreatCircleDistance(s.point)*1000 <= c.distance {
+			nearby = s
+			break
+		}
+	}
+	if nearby == nil {
+		// Scan it
+		s := &pendingScan{point: point, started: now, done: make(chan struct{})}
+		c.scans = append(c.scans, s)
+		c.lock.Unlock()
+		s.response = c.scan(lat, lng, client)
+		if !s.response.Ok {
+			c.remove(s)
+		}
+		close(s.done)
+		return s.response
+	}
+	c.lock.Unlock()
+	scannerMetrics.CoalescedScansPerMinute.Incr(1)
+	if !nearby.finished() {
+		// Wait for the running scan
+		select {
+		case <-nearby.done:
+		case <-time.After(opm.RequestTimeout * time.Second):
+			return opm.APIResponse{Error: opm.ErrScanTimeout.Error()}
+		}
+		response := nearby.response
+		if response.Ok {
+			response.FreshAsOf = nearby.started.Unix()
+		}
+		return response
+	}
+	// Answer from the db
+	objects, err := database.GetMapObjects(lat, lng, opm.MapObjectFilter{Types: []int{opm.POKEMON, opm.POKESTOP, opm.GYM}, Radius: c.radius})
+	if err != nil {
+		return opm.APIResponse{Error: "Failed to get MapObjects from DB"}
+	}
+	return opm.APIResponse{Ok: true, MapObjects: objects, FreshAsOf: nearby.started.Unix()}
+}
+
+// remove forgets a failed scan, so the next request tries again
+func (c *scanCoalescer) remove(scan *pendingScan) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for i, s := range c.scans {
+		if s == scan {
+			c.scans = append(c.scans[:i], c.scans[i+1:]...)
+			return
+		}
+	}
+}
+
+func (s *pendingScan) finished() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
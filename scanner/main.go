@@ -23,9 +23,14 @@ var feed api.Feed
 var crypto api.Crypto
 var trainerQueue *util.TrainerQueue
 var database *db.OpenMapDb
-var scannerStatus status
+var scannerStatus *status
 var scannerMetrics *metrics
-var blacklist map[string]bool
+var blacklist *util.IPList
+var ipResolver *util.IPResolver
+var verifiers util.RouteVerifiers
+var scans *scanCoalescer
+var waitQueue *scanWaitQueue
+var scheduler *areaScheduler
 
 func main() {
 	log.SetFlags(log.Lmicroseconds | log.Lshortfile)
@@ -39,11 +44,14 @@ func main() {
 	if err != nil {
 		log.Printf("Error loading settings (%s). Using default settings.\n", err)
 	}
-	scannerStatus = make(status)
+	scannerStatus = newStatus()
 	crypto = &encrypt.Crypto{}
 	feed = &api.VoidFeed{}
 	api.ProxyHost = fmt.Sprintf("%s:%d", opmSettings.ProxyListenAddress, opmSettings.ProxyListenPort)
-	blacklist = make(map[string]bool)
+	ipResolver, err = util.NewIPResolver(opmSettings.TrustedProxies, opmSettings.ClientIPHeaders)
+	if err != nil {
+		log.Fatal(err)
+	}
 	// Metrics
 	scannerMetrics = NewScannerMetrics()
 	expvar.Publish("scanner_metrics", scannerMetrics)
@@ -52,6 +60,20 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
+	// Request verification
+	verifiers, err = util.NewRouteVerifiers(scannerSettings.Verifiers, util.VerifierOptions{
+		Secret:        opmSettings.Secret,
+		TokenLifetime: time.Duration(scannerSettings.TokenLifetime) * time.Second,
+		Difficulty:    scannerSettings.PowDifficulty,
+		ClientIP:      ipResolver.ClientIP,
+		GetKey:        database.GetAPIKey,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	// Blacklist
+	blacklist = util.NewIPList(database.GetBlacklist)
+	go blacklist.Run(time.Minute)
 	// Load trainers
 	trainers := make([]*util.TrainerSession, 0)
 	for {
@@ -61,7 +83,7 @@ func main() {
 			break
 		}
 		trainers = append(trainers, t)
-		scannerStatus[t.Account.Username] = opm.StatusEntry{AccountName: t.Account.Username, ProxyId: t.Proxy.ID}
+		scannerStatus.Set(t)
 		if len(trainers) >= scannerSettings.Accounts {
 			break
 		}
@@ -95,6 +117,7 @@ func main() {
 	}(trainers)
 	// Init trainerQueue
 	trainerQueue = util.NewTrainerQueue(trainers)
+	expvar.Publish("trainer_queue", trainerQueue)
 	// Start ticker
 	loginTicks = make(chan bool)
 	go func(d time.Duration) {
@@ -111,6 +134,18 @@ func main() {
 			time.Sleep(d)
 		}
 	}(time.Duration(scannerSettings.APICallRate) * time.Millisecond)
+	// Hand out trainers in order
+	waitQueue = newScanWaitQueue(scannerSettings)
+	go waitQueue.Run()
+	// Merge nearby scans
+	scans = newScanCoalescer(scannerSettings, scan)
+	// Scan areas in the background
+	scheduler = newAreaScheduler(scannerSettings)
+	err = scheduler.Load()
+	if err != nil {
+		log.Println(err)
+	}
+	scheduler.Run(scannerSettings.BackgroundWorkers)
 	// Start webserver
 	log.Println("Starting http server")
 	listenAndServe()
@@ -18,13 +18,17 @@ import (
 	"github.com/pogointel/opm/util"
 )
 
-var checkRequest = func(r *http.Request) bool { return true }
+var checkRequest = func(r *http.Request) bool {
+	return util.Internal(r, opmSettings.Secret) || verifiers.Verify(r) == nil
+}
 
 func listenAndServe() {
 	// Setup routes
 	mux := http.NewServeMux()
 	mux.HandleFunc("/status", statusHandler)
-	mux.HandleFunc("/scan", requestHandler)
+	mux.HandleFunc("/admin/areas", areasHandler)
+	mux.HandleFunc("/admin/coverage", coverageHandler)
+	mux.HandleFunc("/scan", httpDecorator(requestHandler))
 	mux.Handle("/debug/vars", http.DefaultServeMux)
 
 	// Start listening
@@ -37,26 +41,53 @@ func listenAndServe() {
 	log.Fatal(s.ListenAndServe())
 }
 
+func httpDecorator(inner func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		// Metadata
+		remoteAddr := ipResolver.ClientIP(r)
+		// Check blacklist and verification
+		if blacklist.Blocked(remoteAddr) || !checkRequest(r) {
+			scannerMetrics.BlockedRequestsPerMinute.Incr(1)
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		// Handle request
+		inner(w, r)
+		// Log it
+		log.Printf("%-6s %-10s %-15s %s", r.Method, r.URL.Path, time.Since(start), remoteAddr)
+	}
+}
+
 func requestHandler(w http.ResponseWriter, r *http.Request) {
-	// Create a context
-	ctx, cancel := context.WithTimeout(context.Background(), opm.RequestTimeout*time.Second)
-	defer cancel()
 	// Check method
 	if r.Method != "POST" {
-		writeScanResponse(w, false, opm.ErrWrongMethod.Error(), nil)
+		writeScanResponse(w, opm.APIResponse{Error: opm.ErrWrongMethod.Error()})
 		return
 	}
 	// Get Latitude and Longitude
 	lat, err := strconv.ParseFloat(r.FormValue("lat"), 64)
 	if err != nil {
-		writeScanResponse(w, false, err.Error(), nil)
+		writeScanResponse(w, opm.APIResponse{Error: err.Error()})
 		return
 	}
 	lng, err := strconv.ParseFloat(r.FormValue("lng"), 64)
 	if err != nil {
-		writeScanResponse(w, false, err.Error(), nil)
+		writeScanResponse(w, opm.APIResponse{Error: err.Error()})
 		return
 	}
+	// Nearby scans are merged
+	writeScanResponse(w, scans.Scan(lat, lng, scanClient(r)))
+}
+
+// scanReserve is the part of the RequestTimeout that is kept for the scan itself
+const scanReserve = 5 * time.Second
+
+// scan performs a scan at lat/lng for client with a trainer from the queue
+func scan(lat, lng float64, client string) opm.APIResponse {
+	// Create a context
+	ctx, cancel := context.WithTimeout(context.Background(), opm.RequestTimeout*time.Second)
+	defer cancel()
 	log.Printf("Scanning %f, %f", lat, lng)
 	// Mock mode
 	if scannerSettings.MockMode {
@@ -71,27 +102,39 @@ func requestHandler(w http.ResponseWriter, r *http.Request) {
 		mapObjects := []opm.MapObject{mockObject}
 		b, _ := json.Marshal(mockObject)
 		log.Printf("Sending mock object: %s", string(b))
-		writeScanResponse(w, true, "", mapObjects)
-		return
+		return opm.APIResponse{Ok: true, MapObjects: mapObjects}
 	}
-	// Get trainer from queue
-	trainer, err := trainerQueue.Get(5 * time.Second)
+	// Wait for a trainer. Only a full queue turns requests away.
+	entered := time.Now()
+	waiter, position, err := waitQueue.Enter(client, lat, lng)
 	if err != nil {
-		// Timeout -> try setup a new one
-		p, err := database.GetProxy()
-		if err != nil {
-			writeScanResponse(w, false, opm.ErrBusy.Error(), nil)
-			return
+		return opm.APIResponse{Error: opm.ErrBusy.Error(), QueuePosition: position + 1, EstimatedWait: waitQueue.Estimate(position + 1)}
+	}
+	estimate := waitQueue.Estimate(position)
+	// Requests that don't get a trainer in time learn how much longer they would have waited
+	timedOut := func() opm.APIResponse {
+		left := estimate - int(time.Since(entered).Seconds())
+		if left < 1 {
+			left = 1
 		}
-		a, err := database.GetAccount()
-		if err != nil {
-			database.ReturnProxy(p)
-			writeScanResponse(w, false, opm.ErrBusy.Error(), nil)
-			return
+		return opm.APIResponse{Error: opm.ErrScanTimeout.Error(), QueuePosition: position, EstimatedWait: left}
+	}
+	// There has to be some time left for the scan
+	deadline, _ := ctx.Deadline()
+	waitCtx, cancelWait := context.WithDeadline(ctx, deadline.Add(-scanReserve))
+	trainer, err := waitQueue.Wait(waitCtx, waiter)
+	cancelWait()
+	if err != nil {
+		return timedOut()
+	}
+	defer waitQueue.Release(client)
+	// Wait until the trainer may travel to lat/lng
+	if wait := time.Until(waiter.ready); wait > 0 {
+		if waiter.ready.After(deadline.Add(-scanReserve)) {
+			trainerQueue.Queue(trainer, 0)
+			return opm.APIResponse{Error: opm.ErrScanTimeout.Error(), EstimatedWait: int(wait.Seconds()) + 1}
 		}
-		trainer = util.NewTrainerSession(a, &api.Location{}, feed, crypto)
-		trainer.SetProxy(p)
-		scannerStatus[trainer.Account.Username] = opm.StatusEntry{AccountName: trainer.Account.Username, ProxyId: trainer.Proxy.ID}
+		time.Sleep(wait)
 	}
 	defer trainerQueue.Queue(trainer, time.Duration(scannerSettings.ScanDelay)*time.Second)
 	trainer.Context = ctx
@@ -101,8 +144,7 @@ func requestHandler(w http.ResponseWriter, r *http.Request) {
 	retrySuccess := false
 	// Check error/timeout
 	if err != nil && ctx.Err() != nil {
-		writeScanResponse(w, false, opm.ErrScanTimeout.Error(), mapObjects)
-		return
+		return opm.APIResponse{Error: opm.ErrScanTimeout.Error(), MapObjects: mapObjects}
 	}
 	// Handle proxy death
 	if err != nil && err == api.ErrProxyDead {
@@ -111,16 +153,16 @@ func requestHandler(w http.ResponseWriter, r *http.Request) {
 		p, err = database.GetProxy()
 		if err == nil {
 			trainer.SetProxy(p)
-			scannerStatus[trainer.Account.Username] = opm.StatusEntry{AccountName: trainer.Account.Username, ProxyId: trainer.Proxy.ID}
+			scannerStatus.Set(trainer)
 			// Retry with new proxy
 			mapObjects, err = getMapResult(trainer, lat, lng)
 			retrySuccess = err == nil
 		} else {
-			delete(scannerStatus, trainer.Account.Username)
+			scannerStatus.Remove(trainer)
+			trainerQueue.Remove(trainer)
 			database.ReturnAccount(trainer.Account)
 			log.Println("No proxies available")
-			writeScanResponse(w, false, opm.ErrBusy.Error(), nil)
-			return
+			return opm.APIResponse{Error: opm.ErrBusy.Error()}
 		}
 	}
 	// Account problems
@@ -130,12 +172,14 @@ func requestHandler(w http.ResponseWriter, r *http.Request) {
 			log.Printf("Account %s banned", trainer.Account.Username)
 			trainer.Account.Banned = true
 			database.UpdateAccount(trainer.Account)
-			delete(scannerStatus, trainer.Account.Username)
+			scannerStatus.Remove(trainer)
+			trainerQueue.Remove(trainer)
 		} else if err == api.ErrCheckChallenge {
 			log.Printf("Account %s flagged for Challenge", trainer.Account.Username)
 			trainer.Account.CaptchaFlagged = true
 			database.UpdateAccount(trainer.Account)
-			delete(scannerStatus, trainer.Account.Username)
+			scannerStatus.Remove(trainer)
+			trainerQueue.Remove(trainer)
 		}
 	}
 	// Just retry when this error comes
@@ -144,32 +188,39 @@ func requestHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	// Final error check
 	if err != nil && !retrySuccess {
-		writeScanResponse(w, false, err.Error(), nil)
-		return
+		return opm.APIResponse{Error: err.Error()}
 	}
 	//Save to db
 	for _, o := range mapObjects {
 		database.AddMapObject(o)
 	}
-	writeScanResponse(w, true, "", mapObjects)
+	learnSpawnpoints(mapObjects)
+	response := opm.APIResponse{Ok: true, MapObjects: mapObjects}
+	if position > 1 {
+		response.QueuePosition, response.EstimatedWait = position, estimate
+	}
+	return response
 }
 
-func writeScanResponse(w http.ResponseWriter, ok bool, e string, response []opm.MapObject) {
-	if !ok {
-		log.Println(e)
-		if e == opm.ErrBusy.Error() {
+func writeScanResponse(w http.ResponseWriter, r opm.APIResponse) {
+	if !r.Ok {
+		log.Println(r.Error)
+		if r.Error == opm.ErrBusy.Error() {
 			scannerMetrics.ScanBusyPerMinute.Incr(1)
 		} else {
 			scannerMetrics.ScanFailsPerMinute.Incr(1)
 		}
 	}
 	w.Header().Add("Content-Type", "application/json")
+	if !r.Ok && r.EstimatedWait > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(r.EstimatedWait))
+	}
 
+	e := r.Error
 	if e != "" && e != opm.ErrScanTimeout.Error() && e != opm.ErrBusy.Error() && e != "Wrong format" && e != "Wrong method" && e != "Failed to get MapObjects from DB" {
-		e = "Scan failed"
+		r.Error = "Scan failed"
 	}
 
-	r := opm.APIResponse{Ok: ok, Error: e, MapObjects: response}
 	err := json.NewEncoder(w).Encode(r)
 	if err != nil {
 		log.Println(err)
@@ -279,11 +330,7 @@ func statusHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	list := make([]opm.StatusEntry, 0)
-	for _, v := range scannerStatus {
-		list = append(list, v)
-	}
-	w.WriteHeader(http.StatusOK)
 	w.Header().Add("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(list)
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(scannerStatus.List())
 }
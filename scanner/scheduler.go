@@ -0,0 +1,318 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pogointel/opm/opm"
+	"github.com/pogointel/opm/util"
+)
+
+// scheduledArea is a ScanArea with its scan locations and progress
+type scheduledArea struct {
+	opm.ScanArea
+	points       []opm.Coordinates
+	next         int         // Index of the next location
+	plan         []spawnScan // Planned scans in spawnpoint mode
+	planEnd      time.Time   // End of the last planned hour
+	Points       int         `json:"points"`     // Scan locations or spawnpoints
+	Cycles       int         `json:"cycles"`     // Number of complete passes
+	LastCycle    int64       `json:"last_cycle"` // Duration of the last pass in seconds
+	Failed       int         `json:"failed"`     // Failed scans in the current pass
+	cycleStarted time.Time
+}
+
+// areaScheduler scans the ScanAreas continuously with a hexagonal step pattern
+// or, in spawnpoint mode, shortly after Pokemon spawn at the known spawnpoints.
+// Areas take turns, the scans run with the lowest priority in the scan queue.
+type areaScheduler struct {
+	lock  sync.Mutex
+	areas []*scheduledArea
+	next  int // Index of the next area
+	step  float64
+}
+
+func newAreaScheduler(s settings) *areaScheduler {
+	return &areaScheduler{step: s.ScanAreaStep}
+}
+
+// Load reads the areas from the db
+func (s *areaScheduler) Load() error {
+	areas, err := database.GetScanAreas()
+	if err != nil {
+		return err
+	}
+	for _, a := range areas {
+		s.set(a)
+	}
+	return nil
+}
+
+// set adds or replaces an area
+func (s *areaScheduler) set(a opm.ScanArea) *scheduledArea {
+	area := &scheduledArea{ScanArea: a, cycleStarted: time.Now()}
+	if a.Mode != opm.ScanAreaSpawnpoints {
+		area.points = util.RegionGrid(a.Region, a.Step)
+		area.Points = len(area.points)
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for i, x := range s.areas {
+		if x.Name == a.Name {
+			s.areas[i] = area
+			return area
+		}
+	}
+	s.areas = append(s.areas, area)
+	return area
+}
+
+func (s *areaScheduler) get(name string) *scheduledArea {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, a := range s.areas {
+		if a.Name == name {
+			return a
+		}
+	}
+	return nil
+}
+
+func (s *areaScheduler) remove(name string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for i, a := range s.areas {
+		if a.Name == name {
+			s.areas = append(s.areas[:i], s.areas[i+1:]...)
+			return
+		}
+	}
+}
+
+// nextPoint returns the next location to scan or false, if there is nothing to do.
+// In spawnpoint mode the planned scan is returned as well.
+func (s *areaScheduler) nextPoint() (*scheduledArea, opm.Coordinates, *spawnScan, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	now := time.Now()
+	for n := 0; n < len(s.areas); n++ {
+		i := (s.next + n) % len(s.areas)
+		a := s.areas[i]
+		if a.Paused {
+			continue
+		}
+		if a.Mode == opm.ScanAreaSpawnpoints {
+			scan, ok := a.dueSpawnScan(now)
+			if !ok {
+				continue
+			}
+			s.next = (i + 1) % len(s.areas)
+			return a, scan.point, &scan, true
+		}
+		if len(a.points) == 0 {
+			continue
+		}
+		s.next = (i + 1) % len(s.areas)
+		p := a.points[a.next]
+		a.next++
+		if a.next >= len(a.points) {
+			a.next = 0
+			a.Cycles++
+			a.LastCycle = int64(time.Since(a.cycleStarted).Seconds())
+			a.Failed = 0
+			a.cycleStarted = time.Now()
+		}
+		return a, p, nil, true
+	}
+	return nil, opm.Coordinates{}, nil, false
+}
+
+// Run scans the areas with the given number of workers.
+// ScanDelay per account is kept by the TrainerQueue.
+func (s *areaScheduler) Run(workers int) {
+	if workers > 0 {
+		go s.planSpawns()
+	}
+	for i := 0; i < workers; i++ {
+		go func() {
+			for {
+				a, p, spawns, ok := s.nextPoint()
+				if !ok {
+					time.Sleep(time.Second)
+					continue
+				}
+				start := time.Now()
+				response := scans.Scan(p.Lat, p.Lng, backgroundClient)
+				scannerMetrics.BackgroundScansPerMinute.Incr(1)
+				if !response.Ok {
+					s.lock.Lock()
+					a.Failed++
+					s.lock.Unlock()
+				}
+				if spawns != nil {
+					recordSpawnCoverage(*spawns, response.MapObjects)
+				}
+				// Results from the db or mock mode come back right away
+				time.Sleep(time.Second - time.Since(start))
+			}
+		}()
+	}
+}
+
+// areasHandler lists (GET), adds (POST), pauses/resumes (PUT) and removes (DELETE) ScanAreas
+func areasHandler(w http.ResponseWriter, r *http.Request) {
+	if !isAdmin(r) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	name := r.FormValue("name")
+	switch r.Method {
+	case "GET":
+		scheduler.lock.Lock()
+		b, err := json.Marshal(scheduler.areas)
+		scheduler.lock.Unlock()
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Add("Content-Type", "application/json")
+		w.Write(b)
+	case "POST":
+		area := opm.ScanArea{Name: name, Mode: opm.ScanAreaGrid, Step: scheduler.step, Created: time.Now().Unix()}
+		switch r.FormValue("mode") {
+		case "", opm.ScanAreaGrid:
+		case opm.ScanAreaSpawnpoints:
+			area.Mode = opm.ScanAreaSpawnpoints
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "Unknown mode: %s\n", r.FormValue("mode"))
+			return
+		}
+		region, err := parseRegion(name, r.FormValue("circle"), r.FormValue("polygon"))
+		if err == nil && r.FormValue("step") != "" {
+			area.Step, err = strconv.ParseFloat(r.FormValue("step"), 64)
+			if err == nil && !(area.Step >= 10 && !math.IsInf(area.Step, 0)) {
+				err = fmt.Errorf("Step must be at least 10m")
+			}
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintln(w, err)
+			return
+		}
+		area.Region = region
+		if area.Mode == opm.ScanAreaGrid {
+			// The grid around the region is only built, if it isn't much larger than the limit
+			max := scannerSettings.ScanAreaMaxPoints
+			n := util.RegionGridSize(area.Region, area.Step)
+			if n <= float64(max)*10 {
+				n = float64(len(util.RegionGrid(area.Region, area.Step)))
+			}
+			if n > float64(max) {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprintf(w, "Area has too many scan locations (%.0f > %d)\n", n, max)
+				return
+			}
+		}
+		writeArea(w, area)
+	case "PUT":
+		a := scheduler.get(name)
+		if a == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		area := a.ScanArea
+		switch r.FormValue("paused") {
+		case "true":
+			area.Paused = true
+		case "false":
+			area.Paused = false
+		}
+		writeArea(w, area)
+	case "DELETE":
+		if scheduler.get(name) == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		err := database.RemoveScanArea(name)
+		if err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		scheduler.remove(name)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// writeArea saves an area, hands it to the scheduler and writes it to w
+func writeArea(w http.ResponseWriter, area opm.ScanArea) {
+	err := database.SetScanArea(area)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	a := scheduler.set(area)
+	scheduler.lock.Lock()
+	b, _ := json.Marshal(a)
+	scheduler.lock.Unlock()
+	w.Header().Add("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// parseRegion reads a circle (lat,lng,radius) or a polygon (lat,lng;lat,lng;...)
+func parseRegion(name, circle, polygon string) (opm.Region, error) {
+	region := opm.Region{Name: name}
+	if name == "" || (circle == "") == (polygon == "") {
+		return region, fmt.Errorf("A name and either a circle or a polygon are required")
+	}
+	if circle != "" {
+		values, err := parseFloats(circle)
+		if err != nil || len(values) != 3 {
+			return region, fmt.Errorf("Invalid circle: %s", circle)
+		}
+		if values[2] <= 0 {
+			return region, fmt.Errorf("Invalid radius: %f", values[2])
+		}
+		region.Center = opm.Coordinates{Lat: values[0], Lng: values[1]}
+		region.Radius = values[2]
+		return region, nil
+	}
+	for _, p := range strings.Split(polygon, ";") {
+		values, err := parseFloats(p)
+		if err != nil || len(values) != 2 {
+			return region, fmt.Errorf("Invalid point: %s", p)
+		}
+		region.Polygon = append(region.Polygon, opm.Coordinates{Lat: values[0], Lng: values[1]})
+	}
+	if len(region.Polygon) < 3 {
+		return region, fmt.Errorf("A polygon needs at least 3 points")
+	}
+	return region, nil
+}
+
+func parseFloats(s string) ([]float64, error) {
+	parts := strings.Split(s, ",")
+	values := make([]float64, len(parts))
+	for i, p := range parts {
+		v, err := strconv.ParseFloat(strings.TrimSpace(p), 64)
+		if err != nil {
+			return nil, err
+		}
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return nil, fmt.Errorf("Invalid number: %s", p)
+		}
+		values[i] = v
+	}
+	return values, nil
+}
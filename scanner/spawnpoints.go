@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/kellydunn/golang-geo"
+	"github.com/pogointel/opm/opm"
+	"github.com/pogointel/opm/util"
+)
+
+// spawnScan is a planned scan of nearby spawnpoints
+type spawnScan struct {
+	at     time.Time // Shortly after the last of the Pokemon spawned
+	until  time.Time // The first of the Pokemon disappears
+	point  opm.Coordinates
+	spawns []opm.Spawnpoint
+}
+
+// learnSpawnpoints updates the despawn times of the spawnpoints of scanned Pokemon
+func learnSpawnpoints(objects []opm.MapObject) {
+	now := time.Now().Unix()
+	for _, o := range objects {
+		if o.Type != opm.POKEMON || o.SpawnpointID == "" || o.Expiry == 0 {
+			continue
+		}
+		err := database.UpdateSpawnpoint(opm.Spawnpoint{ID: o.SpawnpointID, Lat: o.Lat, Lng: o.Lng, DespawnSecond: int(o.Expiry % 3600), Updated: now})
+		if err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// clusterSpawnpoints groups spawnpoints that are within radius (in meters) of the first spawnpoint of the group
+func clusterSpawnpoints(spawnpoints []opm.Spawnpoint, radius float64) [][]opm.Spawnpoint {
+	clusters := make([][]opm.Spawnpoint, 0)
+	used := make([]bool, len(spawnpoints))
+	for i, s := range spawnpoints {
+		if used[i] {
+			continue
+		}
+		seed := geo.NewPoint(s.Lat, s.Lng)
+		cluster := []opm.Spawnpoint{s}
+		used[i] = true
+		for j := i + 1; j < len(spawnpoints); j++ {
+			if !used[j] && seed.GreatCircleDistance(geo.NewPoint(spawnpoints[j].Lat, spawnpoints[j].Lng))*1000 <= radius {
+				cluster = append(cluster, spawnpoints[j])
+				used[j] = true
+			}
+		}
+		clusters = append(clusters, cluster)
+	}
+	return clusters
+}
+
+// planSpawnScans plans the scans for the spawns in the hour that starts at hour.
+// Spawns of a cluster that appear within the batch window are caught with a single scan.
+func planSpawnScans(spawnpoints []opm.Spawnpoint, radius float64, hour time.Time, s settings) []spawnScan {
+	delay := time.Duration(s.SpawnScanDelay) * time.Second
+	plan := make([]spawnScan, 0)
+	for _, cluster := range clusterSpawnpoints(spawnpoints, radius) {
+		sort.Slice(cluster, func(i, j int) bool { return cluster[i].SpawnSecond() < cluster[j].SpawnSecond() })
+		for len(cluster) > 0 {
+			n := 1
+			for n < len(cluster) && cluster[n].SpawnSecond()-cluster[0].SpawnSecond() <= s.SpawnBatchWindow {
+				n++
+			}
+			batch := cluster[:n]
+			cluster = cluster[n:]
+			scan := spawnScan{
+				at:     hour.Add(time.Duration(batch[n-1].SpawnSecond())*time.Second + delay),
+				until:  hour.Add(time.Duration(batch[0].SpawnSecond()+opm.SpawnDuration) * time.Second),
+				spawns: batch,
+			}
+			// Scan in the middle of the batch
+			for _, sp := range batch {
+				scan.point.Lat += sp.Lat / float64(n)
+				scan.point.Lng += sp.Lng / float64(n)
+			}
+			plan = append(plan, scan)
+		}
+	}
+	return plan
+}
+
+// planSpawns plans the scans of all spawnpoint areas hour by hour
+func (s *areaScheduler) planSpawns() {
+	for {
+		now := time.Now()
+		hour := now.Truncate(time.Hour)
+		s.lock.Lock()
+		var areas []*scheduledArea
+		for _, a := range s.areas {
+			if a.Mode == opm.ScanAreaSpawnpoints && !a.Paused && !a.planEnd.After(now) {
+				areas = append(areas, a)
+			}
+		}
+		s.lock.Unlock()
+		for _, a := range areas {
+			// Spawnpoints are learned all the time, so they are loaded for every hour
+			minLat, minLng, maxLat, maxLng := util.RegionBounds(a.Region)
+			spawnpoints, err := database.GetSpawnpoints(minLat, minLng, maxLat, maxLng)
+			if err != nil {
+				log.Println(err)
+				continue
+			}
+			inside := spawnpoints[:0]
+			for _, sp := range spawnpoints {
+				if util.InRegion(sp.Lat, sp.Lng, a.Region) {
+					inside = append(inside, sp)
+				}
+			}
+			plan := planSpawnScans(inside, a.Step, hour, scannerSettings)
+			s.lock.Lock()
+			// Add the new hour to the scans that are still pending
+			for _, scan := range plan {
+				if scan.until.After(now) {
+					a.plan = append(a.plan, scan)
+				}
+			}
+			sort.Slice(a.plan, func(i, j int) bool { return a.plan[i].at.Before(a.plan[j].at) })
+			a.planEnd = hour.Add(time.Hour)
+			a.Points = len(inside)
+			s.lock.Unlock()
+		}
+		time.Sleep(10 * time.Second)
+	}
+}
+
+// dueSpawnScan returns the next planned scan of the area that is due.
+// Scans that are too late to catch anything are dropped and counted as missed.
+func (a *scheduledArea) dueSpawnScan(now time.Time) (spawnScan, bool) {
+	for len(a.plan) > 0 && !a.plan[0].at.After(now) {
+		scan := a.plan[0]
+		a.plan = a.plan[1:]
+		if now.Before(scan.until) {
+			return scan, true
+		}
+		go recordSpawnCoverage(scan, nil)
+	}
+	return spawnScan{}, false
+}
+
+// recordSpawnCoverage counts the spawns of a scan as caught, if their Pokemon were found
+func recordSpawnCoverage(scan spawnScan, objects []opm.MapObject) {
+	found := make(map[string]bool)
+	for _, o := range objects {
+		if o.Type == opm.POKEMON && o.SpawnpointID != "" {
+			found[o.SpawnpointID] = true
+		}
+	}
+	day, _ := opm.UsagePeriods(scan.at)
+	for _, sp := range scan.spawns {
+		caught := 0
+		if found[sp.ID] {
+			caught = 1
+		}
+		err := database.AddSpawnCoverage(day, sp.ID, 1, caught)
+		if err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// spawnCoverage is the coverage of a spawnpoint on one day
+type spawnCoverage struct {
+	opm.SpawnCoverage
+	Missed int `json:"missed"`
+}
+
+type coverageReport struct {
+	Day      string          `json:"day"`
+	Expected int             `json:"expected"`
+	Caught   int             `json:"caught"`
+	Missed   int             `json:"missed"`
+	Spawns   []spawnCoverage `json:"spawns"`
+}
+
+// coverageHandler returns the caught and missed spawns of a day (default today)
+func coverageHandler(w http.ResponseWriter, r *http.Request) {
+	if !isAdmin(r) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	day := r.FormValue("day")
+	if day == "" {
+		day, _ = opm.UsagePeriods(time.Now())
+	}
+	if _, err := time.Parse("2006-01-02", day); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	coverage, err := database.GetSpawnCoverage(day)
+	if err != nil {
+		log.Println(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	report := coverageReport{Day: day, Spawns: make([]spawnCoverage, len(coverage))}
+	for i, c := range coverage {
+		report.Spawns[i] = spawnCoverage{c, c.Expected - c.Caught}
+		report.Expected += c.Expected
+		report.Caught += c.Caught
+	}
+	report.Missed = report.Expected - report.Caught
+	w.Header().Add("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
@@ -3,6 +3,8 @@ package main
 import (
 	"encoding/json"
 	"io/ioutil"
+	"net/http"
+	"sync"
 	"time"
 
 	"github.com/paulbellamy/ratecounter"
@@ -13,17 +15,49 @@ import (
 )
 
 type settings struct {
-	Accounts    int  // Number of initial accounts to load from db
-	ScanDelay   int  // Time between scans per account in seconds
-	APICallRate int  // Time between API calls in milliseconds
-	MockMode    bool // Return random pokemon
+	Accounts      int                 // Number of initial accounts to load from db
+	ScanDelay     int                 // Time between scans per account in seconds
+	APICallRate   int                 // Time between API calls in milliseconds
+	MockMode      bool                // Return random pokemon
+	Verifiers     map[string][]string // Verifiers per route (token, signature, pow)
+	TokenLifetime int                 // Lifetime of frontend tokens in seconds
+	PowDifficulty int                 // Number of leading zero bits for proof-of-work challenges
+	// Coalescing of nearby scans
+	CoalesceDistance int // Maximum distance between merged scan requests in meters, 0 disables merging
+	CoalesceWindow   int // Time in seconds a scan is reused for requests nearby
+	CoalesceRadius   int // Radius in meters for answering requests near a recent scan from the db
+	// Waiting for trainers
+	ScanQueueSize         int // Maximum number of scan requests waiting for a trainer
+	ScanClientConcurrency int // Maximum number of scans per client (API key or IP) at the same time, 0 means no limit
+	// Background scanning of ScanAreas
+	BackgroundWorkers int     // Number of background scans at the same time, 0 disables background scanning
+	ScanAreaStep      float64 // Default distance between scan locations in meters
+	ScanAreaMaxPoints int     // Maximum number of scan locations per area
+	SpawnScanDelay    int     // Seconds after a spawn until the spawnpoint is scanned (spawnpoint mode)
+	SpawnBatchWindow  int     // Spawns of nearby spawnpoints within this many seconds are scanned together
+	// Travelling trainers
+	TravelCooldowns []util.Cooldown // Wait after travelling up to a distance (km), sorted by distance. Empty disables the check.
 }
 
 var defaultScannerSettings = settings{
-	Accounts:    1,
-	ScanDelay:   25,
-	APICallRate: 1,
-	MockMode:    false,
+	Accounts:              1,
+	ScanDelay:             25,
+	APICallRate:           1,
+	MockMode:              false,
+	Verifiers:             map[string][]string{},
+	TokenLifetime:         3600,
+	PowDifficulty:         18,
+	CoalesceDistance:      50,
+	CoalesceWindow:        30,
+	CoalesceRadius:        200,
+	ScanQueueSize:         50,
+	ScanClientConcurrency: 2,
+	BackgroundWorkers:     1,
+	ScanAreaStep:          70,
+	ScanAreaMaxPoints:     10000,
+	SpawnScanDelay:        60,
+	SpawnBatchWindow:      300,
+	TravelCooldowns:       util.DefaultCooldowns,
 }
 
 func loadSettings() (settings, error) {
@@ -42,7 +76,45 @@ func loadSettings() (settings, error) {
 	return s, err
 }
 
-type status map[string]opm.StatusEntry
+// isAdmin checks if the request has the secret. Without a secret there is no admin access.
+func isAdmin(r *http.Request) bool {
+	return opmSettings.Secret != "" && r.FormValue("secret") == opmSettings.Secret
+}
+
+// status holds the accounts and proxies in use. Scans update it while the status page reads it.
+type status struct {
+	lock    sync.RWMutex
+	entries map[string]opm.StatusEntry
+}
+
+func newStatus() *status {
+	return &status{entries: make(map[string]opm.StatusEntry)}
+}
+
+// Set records the account and proxy of a trainer
+func (s *status) Set(t *util.TrainerSession) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.entries[t.Account.Username] = opm.StatusEntry{AccountName: t.Account.Username, ProxyId: t.Proxy.ID}
+}
+
+// Remove forgets the account of a trainer
+func (s *status) Remove(t *util.TrainerSession) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.entries, t.Account.Username)
+}
+
+// List returns all accounts and proxies in use
+func (s *status) List() []opm.StatusEntry {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	list := make([]opm.StatusEntry, 0, len(s.entries))
+	for _, v := range s.entries {
+		list = append(list, v)
+	}
+	return list
+}
 
 type metrics struct {
 	// Requests
@@ -52,6 +124,10 @@ type metrics struct {
 	ScanFailsPerMinute  *ratecounter.RateCounter
 	ScanBusyPerMinute   *ratecounter.RateCounter
 	ScanResponseTimesMs *RingBuffer
+	// Merged scan requests
+	CoalescedScansPerMinute *ratecounter.RateCounter
+	// Scans of ScanAreas
+	BackgroundScansPerMinute *ratecounter.RateCounter
 	// Cache
 	CacheRequestsPerMinute     *ratecounter.RateCounter
 	CacheRequestFailsPerMinute *ratecounter.RateCounter
@@ -65,6 +141,8 @@ func NewScannerMetrics() *metrics {
 		ScanFailsPerMinute:         ratecounter.NewRateCounter(time.Minute),
 		ScanBusyPerMinute:          ratecounter.NewRateCounter(time.Minute),
 		ScanResponseTimesMs:        NewBuffer(256),
+		CoalescedScansPerMinute:    ratecounter.NewRateCounter(time.Minute),
+		BackgroundScansPerMinute:   ratecounter.NewRateCounter(time.Minute),
 		CacheRequestsPerMinute:     ratecounter.NewRateCounter(time.Minute),
 		CacheRequestFailsPerMinute: ratecounter.NewRateCounter(time.Minute),
 		CacheResponseTimesNs:       NewBuffer(256),
@@ -72,9 +150,13 @@ func NewScannerMetrics() *metrics {
 }
 
 type scannerMetricsData struct {
-	ScansPerMinute     int64 `json:"scans_per_minute"`
-	ScanFailsPerMinute int64 `json:"scan_fails_per_minute"`
-	ScanBusyPerMinute  int64 `json:"scan_busy_per_minute"`
+	ScansPerMinute      int64          `json:"scans_per_minute"`
+	ScanFailsPerMinute  int64          `json:"scan_fails_per_minute"`
+	ScanBusyPerMinute   int64          `json:"scan_busy_per_minute"`
+	CoalescedPerMinute  int64          `json:"coalesced_scans_per_minute"`
+	BackgroundPerMinute int64          `json:"background_scans_per_minute"`
+	ScanQueueLength     int            `json:"scan_queue_length"`
+	ScanQueueDepths     map[string]int `json:"scan_queue_depths"` // Waiting requests per client
 
 	ScanResponseTimesMax int64   `json:"scan_response_times_max"`
 	ScanResponseTimesMin int64   `json:"scan_response_times_min"`
@@ -137,6 +219,8 @@ func (s *metrics) String() string {
 		ScansPerMinute:             s.ScansPerMinute.Rate(),
 		ScanFailsPerMinute:         s.ScanFailsPerMinute.Rate(),
 		ScanBusyPerMinute:          s.ScanBusyPerMinute.Rate(),
+		CoalescedPerMinute:         s.CoalescedScansPerMinute.Rate(),
+		BackgroundPerMinute:        s.BackgroundScansPerMinute.Rate(),
 		ScanResponseTimesMin:       scanTimesMin,
 		ScanResponseTimesMax:       scanTimesMax,
 		ScanResponseTimesAvg:       scanTimesAvg,
@@ -146,6 +230,10 @@ func (s *metrics) String() string {
 		CacheResponseTimesMax:      cacheTimesMax,
 		CacheResponseTimesMin:      cacheTimesMin,
 	}
+	if waitQueue != nil {
+		data.ScanQueueLength = waitQueue.Len()
+		data.ScanQueueDepths = waitQueue.Depths()
+	}
 	bytes, _ := json.Marshal(data)
 	return string(bytes)
 }
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/pogointel/opm/opm"
+	"github.com/pogointel/opm/util"
+)
+
+// backgroundClient is the client of background scans. It only gets a trainer when no other client can get one.
+const backgroundClient = "background"
+
+// scanClient identifies the client of a scan request by its API key or IP.
+// Keys are checked by the apiserver before the request is forwarded.
+func scanClient(r *http.Request) string {
+	if k := r.Header.Get(util.KeyHeader); k != "" {
+		return "key:" + k
+	}
+	if k := r.URL.Query().Get("key"); k != "" {
+		return "key:" + k
+	}
+	return "ip:" + ipResolver.ClientIP(r)
+}
+
+// scanWaiter is a scan request waiting for a trainer
+type scanWaiter struct {
+	client   string
+	lat, lng float64
+	trainer  chan *util.TrainerSession
+	ready    time.Time // The trainer may scan at lat/lng after its travel cooldown
+}
+
+// clientQueue holds the waiting requests of one client
+type clientQueue struct {
+	waiters []*scanWaiter
+	active  int // Scans with a trainer
+}
+
+// scanWaitQueue hands out trainers to scan requests.
+// Clients take turns (round-robin) and every client gets its requests served in the order they arrived.
+// Background scans come last.
+// Requests are only rejected when the queue is full.
+type scanWaitQueue struct {
+	lock        sync.Mutex
+	cond        *sync.Cond
+	clients     map[string]*clientQueue
+	order       []string // Clients in round-robin order
+	next        int      // Index of the next client in order
+	length      int      // Number of waiting requests
+	max         int
+	concurrency int // Maximum number of scans per client at the same time, 0 means no limit
+	cooldowns   []util.Cooldown
+}
+
+func newScanWaitQueue(s settings) *scanWaitQueue {
+	q := &scanWaitQueue{
+		clients:     make(map[string]*clientQueue),
+		max:         s.ScanQueueSize,
+		concurrency: s.ScanClientConcurrency,
+		cooldowns:   s.TravelCooldowns,
+	}
+	q.cond = sync.NewCond(&q.lock)
+	return q
+}
+
+// Enter adds a request of client for a scan at lat/lng to the queue and returns its position (starting at 1)
+func (q *scanWaitQueue) Enter(client string, lat, lng float64) (*scanWaiter, int, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.length >= q.max {
+		return nil, q.length, opm.ErrBusy
+	}
+	c, ok := q.clients[client]
+	if !ok {
+		c = &clientQueue{}
+		q.clients[client] = c
+		q.order = append(q.order, client)
+	}
+	w := &scanWaiter{client: client, lat: lat, lng: lng, trainer: make(chan *util.TrainerSession, 1)}
+	c.waiters = append(c.waiters, w)
+	q.length++
+	q.cond.Broadcast()
+	return w, q.position(client, len(c.waiters)-1), nil
+}
+
+// position estimates the position of the i-th request of client.
+// Every other client gets up to i+1 turns first.
+func (q *scanWaitQueue) position(client string, i int) int {
+	ahead := i
+	for id, c := range q.clients {
+		if id == client || id == backgroundClient {
+			continue
+		}
+		if len(c.waiters) < i+1 {
+			ahead += len(c.waiters)
+		} else {
+			ahead += i + 1
+		}
+	}
+	return ahead + 1
+}
+
+// Wait blocks until the waiter gets a trainer or the context is done
+func (q *scanWaitQueue) Wait(ctx context.Context, w *scanWaiter) (*util.TrainerSession, error) {
+	select {
+	case t := <-w.trainer:
+		return t, nil
+	case <-ctx.Done():
+	}
+	q.Leave(w)
+	return nil, opm.ErrScanTimeout
+}
+
+// Leave takes a waiting request out of the queue. If a trainer was handed out in the meantime, it is put back.
+func (q *scanWaitQueue) Leave(w *scanWaiter) {
+	if !q.remove(w) {
+		trainerQueue.Queue(<-w.trainer, 0)
+		q.Release(w.client)
+	}
+}
+
+func (q *scanWaitQueue) remove(w *scanWaiter) bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	c := q.clients[w.client]
+	if c == nil {
+		return false
+	}
+	for i, x := range c.waiters {
+		if x == w {
+			c.waiters = append(c.waiters[:i], c.waiters[i+1:]...)
+			q.length--
+			q.forget(w.client)
+			return true
+		}
+	}
+	return false
+}
+
+// Release marks a scan of client as finished
+func (q *scanWaitQueue) Release(client string) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if c := q.clients[client]; c != nil {
+		c.active--
+		q.forget(client)
+	}
+	q.cond.Broadcast()
+}
+
+// forget removes a client without waiting or running scans
+func (q *scanWaitQueue) forget(client string) {
+	c := q.clients[client]
+	if len(c.waiters) > 0 || c.active > 0 {
+		return
+	}
+	delete(q.clients, client)
+	for i, id := range q.order {
+		if id == client {
+			q.order = append(q.order[:i], q.order[i+1:]...)
+			if q.next > i {
+				q.next--
+			}
+			break
+		}
+	}
+}
+
+// eligible returns the index in order of the next client that may get a trainer or -1.
+// The background client is only picked when no other client can get one.
+func (q *scanWaitQueue) eligible() int {
+	background := -1
+	for n := 0; n < len(q.order); n++ {
+		i := (q.next + n) % len(q.order)
+		id := q.order[i]
+		c := q.clients[id]
+		if id == backgroundClient {
+			if len(c.waiters) > 0 {
+				background = i
+			}
+			continue
+		}
+		if len(c.waiters) > 0 && (q.concurrency <= 0 || c.active < q.concurrency) {
+			return i
+		}
+	}
+	return background
+}
+
+// Len returns the number of waiting requests
+func (q *scanWaitQueue) Len() int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return q.length
+}
+
+// Depths returns the number of waiting requests per client
+func (q *scanWaitQueue) Depths() map[string]int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	depths := make(map[string]int)
+	for id, c := range q.clients {
+		if len(c.waiters) > 0 {
+			depths[id] = len(c.waiters)
+		}
+	}
+	return depths
+}
+
+// Estimate returns the estimated wait in seconds for the given position.
+// Every trainer can do one scan per ScanDelay.
+func (q *scanWaitQueue) Estimate(position int) int {
+	pool := trainerQueue.Stats().Trainers
+	if pool < 1 {
+		pool = 1
+	}
+	return (position - 1) / pool * scannerSettings.ScanDelay
+}
+
+// Run passes trainers from the TrainerQueue on to the waiting requests.
+// The trainer with the shortest travel cooldown to the scan location is used.
+// When no trainer becomes available for a while, a new one is set up from the db.
+func (q *scanWaitQueue) Run() {
+	for {
+		// Wait for a request of a client below its limit
+		q.lock.Lock()
+		for q.eligible() == -1 {
+			q.cond.Wait()
+		}
+		c := q.clients[q.order[q.eligible()]]
+		lat, lng := c.waiters[0].lat, c.waiters[0].lng
+		priority := util.PriorityUser
+		if c.waiters[0].client == backgroundClient {
+			priority = util.PriorityBackground
+		}
+		q.lock.Unlock()
+		// Get a trainer
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		trainer, err := trainerQueue.GetBest(ctx, priority, func(t *util.TrainerSession) time.Duration {
+			return t.Cooldown(lat, lng, q.cooldowns)
+		})
+		cancel()
+		if err != nil {
+			// Only user requests add trainers, background scans make do with the ones there are
+			if priority != util.PriorityUser {
+				continue
+			}
+			trainer, err = NewTrainerFromDb()
+			if err == nil {
+				log.Printf("Added trainer %s", trainer.Account.Username)
+				scannerStatus.Set(trainer)
+				trainerQueue.Queue(trainer, 0)
+			}
+			continue
+		}
+		if !q.handOut(trainer) {
+			// All requests gave up in the meantime
+			trainerQueue.Queue(trainer, 0)
+		}
+	}
+}
+
+// handOut gives the trainer to the next eligible request. It returns false, if no request can take it.
+func (q *scanWaitQueue) handOut(trainer *util.TrainerSession) bool {
+	q.lock.Lock()
+	i := q.eligible()
+	if i == -1 {
+		q.lock.Unlock()
+		return false
+	}
+	c := q.clients[q.order[i]]
+	w := c.waiters[0]
+	w.ready = time.Now().Add(trainer.Cooldown(w.lat, w.lng, q.cooldowns))
+	c.waiters = c.waiters[1:]
+	c.active++
+	q.length--
+	q.next = (i + 1) % len(q.order)
+	q.lock.Unlock()
+	w.trainer <- trainer
+	return true
+}
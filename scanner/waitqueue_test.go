@@ -0,0 +1,64 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/pogointel/opm/util"
+)
+
+func TestScanWaitQueueOrder(t *testing.T) {
+	// Requests in the order they arrive
+	requests := []string{"a", "a", "b", backgroundClient, "c"}
+	tests := []struct {
+		name        string
+		concurrency int
+		order       []int // Indices of the requests in the order they get a trainer
+		release     string
+		afterwards  []int // Order after one scan of release finished
+	}{
+		{"round-robin", 0, []int{0, 2, 4, 1, 3}, "", nil},
+		{"concurrency", 1, []int{0, 2, 4, 3}, "a", []int{1}},
+	}
+	for _, test := range tests {
+		q := newScanWaitQueue(settings{ScanQueueSize: len(requests), ScanClientConcurrency: test.concurrency})
+		waiters := make([]*scanWaiter, len(requests))
+		for i, client := range requests {
+			w, _, err := q.Enter(client, 0, 0)
+			if err != nil {
+				t.Fatalf("%s: request %d: %s", test.name, i, err)
+			}
+			waiters[i] = w
+		}
+		if _, _, err := q.Enter("d", 0, 0); err == nil {
+			t.Errorf("%s: full queue accepted a request", test.name)
+		}
+		check := func(order []int) {
+			for _, want := range order {
+				if !q.handOut(&util.TrainerSession{}) {
+					t.Errorf("%s: no request for trainer, want request %d", test.name, want)
+					return
+				}
+				got := -1
+				for i, w := range waiters {
+					select {
+					case <-w.trainer:
+						got = i
+					default:
+					}
+				}
+				if got != want {
+					t.Errorf("%s: request %d got the trainer, want %d", test.name, got, want)
+				}
+			}
+		}
+		check(test.order)
+		if test.release == "" {
+			continue
+		}
+		if q.handOut(&util.TrainerSession{}) {
+			t.Errorf("%s: trainer handed out beyond the concurrency limit", test.name)
+		}
+		q.Release(test.release)
+		check(test.afterwards)
+	}
+}
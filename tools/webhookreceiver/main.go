@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/pogointel/opm/opm"
+)
+
+// Simple receiver for testing outgoing webhooks of the apiserver.
+// Set the URL of an API key to http://localhost:9000/ and run this with the private key of it.
+func main() {
+	port := flag.Int("port", 9000, "Port to listen on")
+	secret := flag.String("secret", "", "Private key of the API key for checking signatures")
+	fail := flag.Bool("fail", false, "Answer every request with an error (for testing retries)")
+	flag.Parse()
+
+	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if *fail {
+			log.Printf("Rejecting webhook (%d bytes)", len(body))
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		// Check signature
+		timestamp, _ := strconv.ParseInt(r.Header.Get(opm.TimestampHeader), 10, 64)
+		valid := opm.CheckSignature(opm.HashKey(*secret), timestamp, body, r.Header.Get(opm.SignatureHeader))
+		// Print objects
+		var payload opm.WebhookPayload
+		err = json.Unmarshal(body, &payload)
+		if err != nil {
+			log.Println(err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		log.Printf("Received %d objects (signature valid: %t)", len(payload.MapObjects), valid)
+		for _, o := range payload.MapObjects {
+			b, _ := json.Marshal(o)
+			fmt.Println(string(b))
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+	log.Printf("Listening on :%d", *port)
+	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", *port), nil))
+}
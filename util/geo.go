@@ -1,10 +1,12 @@
 package util
 
 import (
+	"math"
 	"math/rand"
 	"time"
 
 	"github.com/kellydunn/golang-geo"
+	"github.com/pogointel/opm/opm"
 )
 
 // LatLngOffset returns a new pair of coordinates at a given distance in a random direction
@@ -13,3 +15,113 @@ func LatLngOffset(lat, lng, distance float64) (float64, float64) {
 	newPoint := geo.NewPoint(lat, lng).PointAtDistanceAndBearing(distance, float64(rand.Intn(360)))
 	return newPoint.Lat(), newPoint.Lng()
 }
+
+// InPolygon checks if the given coordinates are inside of the polygon (ray casting)
+func InPolygon(lat, lng float64, polygon []opm.Coordinates) bool {
+	inside := false
+	for i, j := 0, len(polygon)-1; i < len(polygon); j, i = i, i+1 {
+		a, b := polygon[i], polygon[j]
+		if (a.Lng > lng) != (b.Lng > lng) && lat < (b.Lat-a.Lat)*(lng-a.Lng)/(b.Lng-a.Lng)+a.Lat {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+// InRegion checks if the given coordinates are inside of the region
+func InRegion(lat, lng float64, region opm.Region) bool {
+	if len(region.Polygon) > 2 {
+		return InPolygon(lat, lng, region.Polygon)
+	}
+	return geo.NewPoint(lat, lng).GreatCircleDistance(geo.NewPoint(region.Center.Lat, region.Center.Lng))*1000 <= region.Radius
+}
+
+// InRegions checks if the given coordinates are inside of any of the regions
+func InRegions(lat, lng float64, regions []opm.Region) bool {
+	for _, r := range regions {
+		if InRegion(lat, lng, r) {
+			return true
+		}
+	}
+	return false
+}
+
+// hexDirections are the axial offsets (q, r) of the six neighbours of a hexagon, in order around it
+var hexDirections = [6][2]int{{1, 0}, {1, -1}, {0, -1}, {-1, 0}, {-1, 1}, {0, 1}}
+
+// HexGrid returns the centers of a hexagonal grid around lat/lng with the given number of rings.
+// step is the distance between neighbouring points in meters. The center comes first, then ring by ring.
+func HexGrid(lat, lng float64, rings int, step float64) []opm.Coordinates {
+	if rings < 0 {
+		rings = 0
+	}
+	points := make([]opm.Coordinates, 0, 1+3*rings*(rings+1))
+	points = append(points, opm.Coordinates{Lat: lat, Lng: lng})
+	metersPerLng := 111320 * math.Cos(lat*math.Pi/180)
+	for k := 1; k <= rings; k++ {
+		// Walk the six edges of ring k, starting at its corner in the last direction
+		q, r := hexDirections[4][0]*k, hexDirections[4][1]*k
+		for _, d := range hexDirections {
+			for i := 0; i < k; i++ {
+				x := step * (float64(q) + float64(r)/2)
+				y := step * float64(r) * math.Sqrt(3) / 2
+				points = append(points, opm.Coordinates{Lat: lat + y/111320, Lng: lng + x/metersPerLng})
+				q, r = q+d[0], r+d[1]
+			}
+		}
+	}
+	return points
+}
+
+// RegionBounds returns the bounding box of the region
+func RegionBounds(region opm.Region) (minLat, minLng, maxLat, maxLng float64) {
+	if len(region.Polygon) > 2 {
+		minLat, maxLat = region.Polygon[0].Lat, region.Polygon[0].Lat
+		minLng, maxLng = region.Polygon[0].Lng, region.Polygon[0].Lng
+		for _, p := range region.Polygon {
+			minLat, maxLat = math.Min(minLat, p.Lat), math.Max(maxLat, p.Lat)
+			minLng, maxLng = math.Min(minLng, p.Lng), math.Max(maxLng, p.Lng)
+		}
+		return
+	}
+	dLat := region.Radius / 111320
+	dLng := region.Radius / (111320 * math.Cos(region.Center.Lat*math.Pi/180))
+	return region.Center.Lat - dLat, region.Center.Lng - dLng, region.Center.Lat + dLat, region.Center.Lng + dLng
+}
+
+// RegionGrid returns the centers of a hexagonal grid that covers the region.
+// step is the distance between neighbouring points in meters.
+func RegionGrid(region opm.Region, step float64) []opm.Coordinates {
+	center, rings := regionRings(region, step)
+	points := make([]opm.Coordinates, 0)
+	for _, p := range HexGrid(center.Lat, center.Lng, rings, step) {
+		if InRegion(p.Lat, p.Lng, region) {
+			points = append(points, p)
+		}
+	}
+	return points
+}
+
+// RegionGridSize returns the number of points of the grid that RegionGrid starts from, without building it.
+// It is an upper bound for the number of points inside the region.
+func RegionGridSize(region opm.Region, step float64) float64 {
+	_, rings := regionRings(region, step)
+	return 1 + 3*float64(rings)*float64(rings+1)
+}
+
+// regionRings returns the center and the number of rings of a hexagonal grid that covers the region
+func regionRings(region opm.Region, step float64) (opm.Coordinates, int) {
+	center, radius := region.Center, region.Radius
+	if len(region.Polygon) > 2 {
+		// Circle around the bounding box
+		minLat, minLng, maxLat, maxLng := RegionBounds(region)
+		center = opm.Coordinates{Lat: (minLat + maxLat) / 2, Lng: (minLng + maxLng) / 2}
+		radius = geo.NewPoint(minLat, minLng).GreatCircleDistance(geo.NewPoint(maxLat, maxLng)) * 1000 / 2
+	}
+	// Ring k is at least k*step*sqrt(3)/2 away from the center
+	rings := math.Ceil(radius/(step*math.Sqrt(3)/2)) + 1
+	if rings > math.MaxInt32 {
+		rings = math.MaxInt32
+	}
+	return center, int(rings)
+}
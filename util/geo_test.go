@@ -0,0 +1,62 @@
+package util
+
+import (
+	"math"
+	"testing"
+
+	"github.com/kellydunn/golang-geo"
+	"github.com/pogointel/opm/opm"
+)
+
+func TestHexGrid(t *testing.T) {
+	tests := []struct {
+		rings  int
+		points int
+	}{
+		{-1, 1},
+		{0, 1},
+		{1, 7},
+		{2, 19},
+		{5, 91},
+	}
+	const lat, lng, step = 52.52, 13.4, 70.0
+	for _, test := range tests {
+		points := HexGrid(lat, lng, test.rings, step)
+		if len(points) != test.points {
+			t.Errorf("%d rings: got %d points, want %d", test.rings, len(points), test.points)
+			continue
+		}
+		if points[0] != (opm.Coordinates{Lat: lat, Lng: lng}) {
+			t.Errorf("%d rings: first point %v is not the center", test.rings, points[0])
+		}
+		// Every point has its own place, and the closest other point is step away
+		for i, p := range points {
+			closest := math.Inf(1)
+			for j, q := range points {
+				if i == j {
+					continue
+				}
+				d := geo.NewPoint(p.Lat, p.Lng).GreatCircleDistance(geo.NewPoint(q.Lat, q.Lng)) * 1000
+				closest = math.Min(closest, d)
+			}
+			if len(points) > 1 && math.Abs(closest-step) > 1 {
+				t.Errorf("%d rings: closest neighbour of point %d is %.1fm away, want %.0fm", test.rings, i, closest, step)
+			}
+		}
+	}
+}
+
+func TestRegionGridSize(t *testing.T) {
+	tests := []opm.Region{
+		{Center: opm.Coordinates{Lat: 52.52, Lng: 13.4}, Radius: 500},
+		{Center: opm.Coordinates{Lat: 52.52, Lng: 13.4}, Radius: 2000},
+		{Polygon: []opm.Coordinates{{Lat: 52.50, Lng: 13.38}, {Lat: 52.53, Lng: 13.38}, {Lat: 52.52, Lng: 13.42}}},
+	}
+	for i, region := range tests {
+		size := RegionGridSize(region, 70)
+		points := RegionGrid(region, 70)
+		if len(points) == 0 || float64(len(points)) > size {
+			t.Errorf("region %d: got %d points, estimated at most %.0f", i, len(points), size)
+		}
+	}
+}
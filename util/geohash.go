@@ -0,0 +1,106 @@
+package util
+
+import (
+	"math"
+	"strings"
+)
+
+const geohashAlphabet = "0123456789bcdefghjkmnpqrstuvwxyz"
+
+// Geohash encodes the coordinates as geohash with the given number of characters
+func Geohash(lat, lng float64, precision int) string {
+	minLat, maxLat := -90.0, 90.0
+	minLng, maxLng := -180.0, 180.0
+	hash := make([]byte, precision)
+	even := true
+	for i := range hash {
+		var c byte
+		for bit := 4; bit >= 0; bit-- {
+			if even {
+				mid := (minLng + maxLng) / 2
+				if lng >= mid {
+					c |= 1 << uint(bit)
+					minLng = mid
+				} else {
+					maxLng = mid
+				}
+			} else {
+				mid := (minLat + maxLat) / 2
+				if lat >= mid {
+					c |= 1 << uint(bit)
+					minLat = mid
+				} else {
+					maxLat = mid
+				}
+			}
+			even = !even
+		}
+		hash[i] = geohashAlphabet[c]
+	}
+	return string(hash)
+}
+
+// GeohashSize returns the height and width (in degrees) of the cells with the given precision
+func GeohashSize(precision int) (float64, float64) {
+	latBits := precision * 5 / 2
+	lngBits := precision*5 - latBits
+	return 180 / math.Pow(2, float64(latBits)), 360 / math.Pow(2, float64(lngBits))
+}
+
+// GeohashesAround returns the geohashes of all cells that intersect the circle around lat/lng (radius in meters)
+func GeohashesAround(lat, lng, radius float64, precision int) []string {
+	// Bounding box of the circle
+	dLat := radius / 111320
+	dLng := radius / (111320 * math.Max(math.Cos(lat*math.Pi/180), 0.01))
+	height, width := GeohashSize(precision)
+	seen := make(map[string]bool)
+	var hashes []string
+	for y := lat - dLat; ; y += height {
+		y = math.Min(y, lat+dLat)
+		for x := lng - dLng; ; x += width {
+			x = math.Min(x, lng+dLng)
+			h := Geohash(y, x, precision)
+			if !seen[h] {
+				seen[h] = true
+				hashes = append(hashes, h)
+			}
+			if x >= lng+dLng {
+				break
+			}
+		}
+		if y >= lat+dLat {
+			break
+		}
+	}
+	return hashes
+}
+
+// GeohashCenter returns the center of a geohash cell
+func GeohashCenter(hash string) (float64, float64) {
+	minLat, maxLat := -90.0, 90.0
+	minLng, maxLng := -180.0, 180.0
+	even := true
+	for i := 0; i < len(hash); i++ {
+		c := strings.IndexByte(geohashAlphabet, hash[i])
+		for bit := 4; bit >= 0; bit-- {
+			set := c&(1<<uint(bit)) != 0
+			if even {
+				mid := (minLng + maxLng) / 2
+				if set {
+					minLng = mid
+				} else {
+					maxLng = mid
+				}
+			} else {
+				mid := (minLat + maxLat) / 2
+				if set {
+					minLat = mid
+				} else {
+					maxLat = mid
+				}
+			}
+			even = !even
+		}
+	}
+	return (minLat + maxLat) / 2, (minLng + maxLng) / 2
+}
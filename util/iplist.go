@@ -0,0 +1,95 @@
+package util
+
+import (
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pogointel/opm/opm"
+)
+
+type ipListEntry struct {
+	net   *net.IPNet
+	entry opm.BlacklistEntry
+}
+
+// IPList is an in-memory copy of the blacklist/allowlist.
+// The entries are provided by the load function (usually from the db).
+type IPList struct {
+	load    func() ([]opm.BlacklistEntry, error)
+	lock    sync.RWMutex
+	entries []ipListEntry
+}
+
+// NewIPList creates a new (empty) IPList. Call Reload or Run to fill it.
+func NewIPList(load func() ([]opm.BlacklistEntry, error)) *IPList {
+	return &IPList{load: load}
+}
+
+// Run reloads the list periodically
+func (l *IPList) Run(interval time.Duration) {
+	for {
+		err := l.Reload()
+		if err != nil {
+			log.Println(err)
+		}
+		time.Sleep(interval)
+	}
+}
+
+// Reload replaces the list with the entries from the load function
+func (l *IPList) Reload() error {
+	list, err := l.load()
+	if err != nil {
+		return err
+	}
+	entries := make([]ipListEntry, 0, len(list))
+	for _, e := range list {
+		n, err := ParseCIDR(e.CIDR)
+		if err != nil {
+			log.Printf("Invalid blacklist entry %s: %s", e.CIDR, err)
+			continue
+		}
+		entries = append(entries, ipListEntry{net: n, entry: e})
+	}
+	l.lock.Lock()
+	l.entries = entries
+	l.lock.Unlock()
+	return nil
+}
+
+// Blocked checks if an address is blacklisted. Allowlist entries take precedence.
+func (l *IPList) Blocked(addr string) bool {
+	ip := net.ParseIP(StripPort(addr))
+	if ip == nil {
+		return false
+	}
+	now := time.Now().Unix()
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	blocked := false
+	for _, e := range l.entries {
+		if e.entry.Expiry != 0 && e.entry.Expiry <= now {
+			continue
+		}
+		if e.net.Contains(ip) {
+			if e.entry.Allow {
+				return false
+			}
+			blocked = true
+		}
+	}
+	return blocked
+}
+
+// Entries returns a copy of all entries
+func (l *IPList) Entries() []opm.BlacklistEntry {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	entries := make([]opm.BlacklistEntry, len(l.entries))
+	for i, e := range l.entries {
+		entries[i] = e.entry
+	}
+	return entries
+}
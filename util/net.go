@@ -0,0 +1,99 @@
+package util
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ParseCIDR parses a CIDR range. Single IP addresses are treated as /32 (IPv4) or /128 (IPv6) ranges.
+func ParseCIDR(s string) (*net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, &net.ParseError{Type: "IP address", Text: s}
+		}
+		if ip.To4() != nil {
+			return &net.IPNet{IP: ip.To4(), Mask: net.CIDRMask(32, 32)}, nil
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+	}
+	_, ipNet, err := net.ParseCIDR(s)
+	return ipNet, err
+}
+
+// StripPort removes the port from an address, if it has one
+func StripPort(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+// IPResolver resolves the address of the client that sent a request.
+// Headers are only used if the request comes from a trusted proxy.
+type IPResolver struct {
+	trusted []*net.IPNet
+	headers []string
+}
+
+// NewIPResolver creates a new IPResolver for the trusted proxy ranges.
+// The headers are checked in the given order.
+func NewIPResolver(trustedProxies []string, headers []string) (*IPResolver, error) {
+	r := &IPResolver{headers: headers}
+	for _, p := range trustedProxies {
+		n, err := ParseCIDR(p)
+		if err != nil {
+			return nil, err
+		}
+		r.trusted = append(r.trusted, n)
+	}
+	return r, nil
+}
+
+// Trusted checks if the address belongs to a trusted proxy
+func (r *IPResolver) Trusted(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, n := range r.trusted {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP returns the address of the client that sent the request
+func (r *IPResolver) ClientIP(req *http.Request) string {
+	remoteAddr := StripPort(req.RemoteAddr)
+	if !r.Trusted(remoteAddr) {
+		return remoteAddr
+	}
+	for _, h := range r.headers {
+		value := req.Header.Get(h)
+		if value == "" {
+			continue
+		}
+		if http.CanonicalHeaderKey(h) == "X-Forwarded-For" {
+			// Walk the list backwards and skip our own proxies
+			addrs := strings.Split(strings.Join(req.Header[http.CanonicalHeaderKey(h)], ","), ",")
+			for i := len(addrs) - 1; i >= 0; i-- {
+				addr := strings.TrimSpace(addrs[i])
+				if net.ParseIP(addr) == nil {
+					break
+				}
+				if !r.Trusted(addr) || i == 0 {
+					return addr
+				}
+			}
+			continue
+		}
+		if ip := net.ParseIP(strings.TrimSpace(value)); ip != nil {
+			return ip.String()
+		}
+	}
+	return remoteAddr
+}
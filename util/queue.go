@@ -1,67 +1,346 @@
 package util
 
 import (
+	"encoding/json"
+	"sync"
 	"time"
 
+	"golang.org/x/net/context"
+
 	"github.com/pogointel/opm/opm"
 )
 
+// Priority of a request for a trainer. Requests with a lower value are served first.
+type Priority int
+
+const (
+	PriorityUser        Priority = iota // Requests of clients
+	PriorityBackground                  // Background scans
+	PriorityMaintenance                 // Account checks and other housekeeping
+)
+
+var priorityNames = []string{"user", "background", "maintenance"}
+
+func (p Priority) String() string {
+	if p < 0 || int(p) >= len(priorityNames) {
+		return "unknown"
+	}
+	return priorityNames[p]
+}
+
+// States of the trainers in a TrainerQueue
+const (
+	trainerAvailable = iota
+	trainerInUse
+	trainerDelayed
+)
+
+// trainerRequest is a Get call waiting for a trainer
+type trainerRequest struct {
+	priority Priority
+	cost     func(*TrainerSession) time.Duration
+	reply    chan *TrainerSession
+}
+
+// TrainerQueue hands out *TrainerSessions to the waiting requests with the highest priority.
+// Requests with the same priority are served in the order they arrived.
 type TrainerQueue struct {
-	in     chan *TrainerSession
-	out    chan *TrainerSession
-	buffer []*TrainerSession
+	lock     sync.Mutex
+	buffer   []*TrainerSession // Available trainers, longest waiting first
+	trainers map[*TrainerSession]int
+	timers   map[*TrainerSession]*time.Timer // Delayed trainers
+	removed  map[*TrainerSession]bool
+	requests []*trainerRequest
+	changed  chan struct{} // Closed when a trainer comes back
+	closed   bool
+	timeouts int64
+}
+
+// TrainerQueueStats describes the state of a TrainerQueue
+type TrainerQueueStats struct {
+	Trainers  int            `json:"trainers"` // Trainers in the queue, including those in use or delayed
+	Available int            `json:"available"`
+	InUse     int            `json:"in_use"`
+	Delayed   int            `json:"delayed"`
+	Waiting   map[string]int `json:"waiting"` // Waiting requests per priority
+	Removed   int            `json:"removed"` // Removed trainers that are still in use
+	Timeouts  int64          `json:"timeouts"`
+	Closed    bool           `json:"closed"`
 }
 
-// NewTrainerQueue creates a new buffered queue of *TrainerSessions.
-// The initial buffer is filled with the provided *TrainerSessions.
+// NewTrainerQueue creates a new queue of *TrainerSessions.
+// The queue is filled with the provided *TrainerSessions.
 func NewTrainerQueue(trainers []*TrainerSession) *TrainerQueue {
-	// Create queue
 	tq := &TrainerQueue{
-		in:     make(chan *TrainerSession),
-		out:    make(chan *TrainerSession),
-		buffer: trainers,
+		trainers: make(map[*TrainerSession]int),
+		timers:   make(map[*TrainerSession]*time.Timer),
+		removed:  make(map[*TrainerSession]bool),
+		changed:  make(chan struct{}),
+	}
+	for _, ts := range trainers {
+		tq.put(ts)
 	}
-	// Start *TrainerSession queue/dequeue
-	go tq.queue()
-	// Return TrainerQueue
 	return tq
 }
 
-// queue handles the buffer and sends/receives trainers on in/out channels
-func (t *TrainerQueue) queue() {
+// Get requests a *TrainerSession from the queue.
+// This will block until a *TrainerSession is available or the context is done.
+func (t *TrainerQueue) Get(ctx context.Context, priority Priority) (*TrainerSession, error) {
+	return t.GetBest(ctx, priority, nil)
+}
+
+// GetBest requests the *TrainerSession with the lowest cost (e.g. the remaining travel cooldown) from the queue.
+// This will block until a *TrainerSession is available or the context is done.
+func (t *TrainerQueue) GetBest(ctx context.Context, priority Priority, cost func(*TrainerSession) time.Duration) (*TrainerSession, error) {
+	r := &trainerRequest{priority: priority, cost: cost, reply: make(chan *TrainerSession, 1)}
+	t.lock.Lock()
+	if t.closed {
+		t.lock.Unlock()
+		return nil, opm.ErrQueueClosed
+	}
+	// Behind all requests with the same or a higher priority
+	i := len(t.requests)
+	for i > 0 && t.requests[i-1].priority > priority {
+		i--
+	}
+	t.requests = append(t.requests, nil)
+	copy(t.requests[i+1:], t.requests[i:])
+	t.requests[i] = r
+	t.dispatch()
+	t.lock.Unlock()
+
+	select {
+	case ts := <-r.reply:
+		if ts == nil {
+			return nil, opm.ErrQueueClosed
+		}
+		return ts, nil
+	case <-ctx.Done():
+	}
+	t.lock.Lock()
+	waiting := t.removeRequest(r)
+	t.timeouts++
+	t.lock.Unlock()
+	if !waiting {
+		// A trainer was handed out in the meantime
+		if ts := <-r.reply; ts != nil {
+			t.Queue(ts, 0)
+		}
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		return nil, opm.ErrTimeout
+	}
+	return nil, ctx.Err()
+}
+
+// Queue returns a *TrainerSession to the queue after delay. Also adds new *TrainerSessions.
+// Removed *TrainerSessions and those with a banned or captcha flagged account or a dead proxy are dropped.
+func (t *TrainerQueue) Queue(ts *TrainerSession, delay time.Duration) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.removed[ts] {
+		// It won't come back again
+		delete(t.removed, ts)
+		return
+	}
+	if ts.Account.Banned || ts.Proxy.Dead || ts.Account.CaptchaFlagged {
+		t.forget(ts)
+		t.notify()
+		return
+	}
+	t.forget(ts)
+	if delay <= 0 {
+		t.put(ts)
+		return
+	}
+	t.trainers[ts] = trainerDelayed
+	t.timers[ts] = time.AfterFunc(delay, func() {
+		t.lock.Lock()
+		defer t.lock.Unlock()
+		if t.timers[ts] == nil {
+			// Removed or drained
+			return
+		}
+		delete(t.timers, ts)
+		t.put(ts)
+	})
+}
+
+// Remove takes a *TrainerSession out of the queue for good (e.g. a banned account)
+func (t *TrainerQueue) Remove(ts *TrainerSession) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.trainers[ts] == trainerInUse {
+		// Ignore it when it is queued again
+		t.removed[ts] = true
+	}
+	t.forget(ts)
+	t.notify()
+}
+
+// Len returns the number of available *TrainerSessions
+func (t *TrainerQueue) Len() int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return len(t.buffer)
+}
+
+// Stats returns the current state of the queue
+func (t *TrainerQueue) Stats() TrainerQueueStats {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	stats := TrainerQueueStats{
+		Trainers: len(t.trainers),
+		Waiting:  make(map[string]int),
+		Removed:  len(t.removed),
+		Timeouts: t.timeouts,
+		Closed:   t.closed,
+	}
+	for _, state := range t.trainers {
+		switch state {
+		case trainerAvailable:
+			stats.Available++
+		case trainerInUse:
+			stats.InUse++
+		case trainerDelayed:
+			stats.Delayed++
+		}
+	}
+	for _, r := range t.requests {
+		stats.Waiting[r.priority.String()]++
+	}
+	return stats
+}
+
+func (t *TrainerQueue) String() string {
+	b, _ := json.Marshal(t.Stats())
+	return string(b)
+}
+
+// Close stops handing out *TrainerSessions. Waiting and future Get calls return opm.ErrQueueClosed.
+// Trainers can still be returned, so they can be collected with Drain.
+func (t *TrainerQueue) Close() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.closed = true
+	for _, r := range t.requests {
+		r.reply <- nil
+	}
+	t.requests = nil
+}
+
+// Drain closes the queue, waits until the trainers in use are returned (or the context is done)
+// and takes all *TrainerSessions out of the queue. Delayed trainers are returned right away.
+func (t *TrainerQueue) Drain(ctx context.Context) []*TrainerSession {
+	t.Close()
 	for {
-		if len(t.buffer) > 0 {
-			select {
-			case t.out <- t.buffer[0]:
-				t.buffer = t.buffer[1:]
-			case s := <-t.in:
-				t.buffer = append(t.buffer, s)
+		t.lock.Lock()
+		inUse := 0
+		for _, state := range t.trainers {
+			if state == trainerInUse {
+				inUse++
 			}
-		} else {
-			s := <-t.in
-			t.buffer = append(t.buffer, s)
+		}
+		changed := t.changed
+		t.lock.Unlock()
+		if inUse == 0 {
+			break
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	trainers := make([]*TrainerSession, 0, len(t.trainers))
+	for ts, state := range t.trainers {
+		if state != trainerInUse {
+			trainers = append(trainers, ts)
+			t.forget(ts)
 		}
 	}
+	return trainers
 }
 
-// Get requests a *TrainerSession from the queue
-// This will block until a *TrainerSession is available
-func (t *TrainerQueue) Get(timeout time.Duration) (*TrainerSession, error) {
-	select {
-	case trainer := <-t.out:
-		return trainer, nil
-	case <-time.After(timeout):
-		return &TrainerSession{}, opm.ErrTimeout
+// put makes a trainer available. The lock must be held.
+func (t *TrainerQueue) put(ts *TrainerSession) {
+	if !t.contains(ts) {
+		t.buffer = append(t.buffer, ts)
 	}
+	t.trainers[ts] = trainerAvailable
+	t.notify()
+	t.dispatch()
 }
 
-// Queue returns a *TrainerSession to the queue. Also adds new *TrainerSessions.
-func (t *TrainerQueue) Queue(ts *TrainerSession, delay time.Duration) {
-	if ts.Account.Banned || ts.Proxy.Dead || ts.Account.CaptchaFlagged {
+func (t *TrainerQueue) contains(ts *TrainerSession) bool {
+	for _, x := range t.buffer {
+		if x == ts {
+			return true
+		}
+	}
+	return false
+}
+
+// dispatch hands out available trainers to the waiting requests. The lock must be held.
+func (t *TrainerQueue) dispatch() {
+	if t.closed {
 		return
 	}
-	go func(x *TrainerSession) {
-		time.Sleep(delay)
-		t.in <- x
-	}(ts)
+	for len(t.requests) > 0 && len(t.buffer) > 0 {
+		r := t.requests[0]
+		t.requests = t.requests[1:]
+		// The longest waiting trainer wins ties, so trainers are still used in turns
+		best := 0
+		if r.cost != nil {
+			bestCost := r.cost(t.buffer[0])
+			for i := 1; i < len(t.buffer) && bestCost > 0; i++ {
+				if c := r.cost(t.buffer[i]); c < bestCost {
+					best, bestCost = i, c
+				}
+			}
+		}
+		ts := t.buffer[best]
+		t.buffer = append(t.buffer[:best], t.buffer[best+1:]...)
+		t.trainers[ts] = trainerInUse
+		r.reply <- ts
+	}
+}
+
+// removeRequest removes a waiting request. It returns false, if the request isn't waiting anymore.
+// The lock must be held.
+func (t *TrainerQueue) removeRequest(r *trainerRequest) bool {
+	for i, x := range t.requests {
+		if x == r {
+			t.requests = append(t.requests[:i], t.requests[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// forget removes all traces of a trainer except the removed mark. The lock must be held.
+func (t *TrainerQueue) forget(ts *TrainerSession) {
+	if timer, ok := t.timers[ts]; ok {
+		timer.Stop()
+		delete(t.timers, ts)
+	}
+	if t.trainers[ts] == trainerAvailable {
+		for i, x := range t.buffer {
+			if x == ts {
+				t.buffer = append(t.buffer[:i], t.buffer[i+1:]...)
+				break
+			}
+		}
+	}
+	delete(t.trainers, ts)
+}
+
+// notify wakes up Drain. The lock must be held.
+func (t *TrainerQueue) notify() {
+	close(t.changed)
+	t.changed = make(chan struct{})
 }
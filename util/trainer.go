@@ -3,6 +3,7 @@ package util
 import (
 	"golang.org/x/net/context"
 	"log"
+	"time"
 
 	"github.com/femot/pgoapi-go/api"
 	"github.com/femot/pgoapi-go/auth"
@@ -17,6 +18,8 @@ type TrainerSession struct {
 	failCount  int
 	Feed       api.Feed
 	Location   *api.Location
+	LastAction time.Time    // Last time the trainer requested the map
+	ActionAt   api.Location // Location of the last action
 	Proxy      opm.Proxy
 	session    *api.Session
 	ForceLogin bool
@@ -89,6 +92,11 @@ func (t *TrainerSession) GetPlayer() (*protos.GetPlayerResponse, error) {
 	return t.session.GetPlayer(t.Context, t.Proxy.ID)
 }
 func (t *TrainerSession) GetPlayerMap() (*protos.GetMapObjectsResponse, error) {
+	// The cooldown counts from the last action, wherever the trainer moved since
+	t.LastAction = time.Now()
+	if t.Location != nil {
+		t.ActionAt = *t.Location
+	}
 	return t.session.GetPlayerMap(t.Context, t.Proxy.ID)
 }
 func (t *TrainerSession) MoveTo(location *api.Location) {
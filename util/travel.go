@@ -0,0 +1,56 @@
+package util
+
+import (
+	"time"
+
+	"github.com/kellydunn/golang-geo"
+)
+
+// Cooldown is the time a trainer has to wait after travelling up to Distance (in km)
+type Cooldown struct {
+	Distance float64 // Kilometers
+	Wait     int     // Seconds
+}
+
+// DefaultCooldowns is a conservative table for teleporting trainers
+var DefaultCooldowns = []Cooldown{
+	{1, 0},
+	{2, 60},
+	{5, 120},
+	{10, 360},
+	{25, 660},
+	{65, 1320},
+	{100, 2100},
+	{250, 2700},
+	{500, 3600},
+	{1000, 5400},
+	{1500, 7200},
+}
+
+// TravelCooldown returns the wait for a trip of distance km.
+// The table is sorted by distance, longer trips than the last entry need its wait.
+func TravelCooldown(distance float64, table []Cooldown) time.Duration {
+	if len(table) == 0 {
+		return 0
+	}
+	for _, c := range table {
+		if distance <= c.Distance {
+			return time.Duration(c.Wait) * time.Second
+		}
+	}
+	return time.Duration(table[len(table)-1].Wait) * time.Second
+}
+
+// Cooldown returns the time until the trainer may be at lat/lng without exceeding the cooldown table
+func (t *TrainerSession) Cooldown(lat, lng float64, table []Cooldown) time.Duration {
+	if t.LastAction.IsZero() || (t.ActionAt.Lat == 0 && t.ActionAt.Lon == 0) {
+		// No action yet
+		return 0
+	}
+	distance := geo.NewPoint(t.ActionAt.Lat, t.ActionAt.Lon).GreatCircleDistance(geo.NewPoint(lat, lng))
+	wait := t.LastAction.Add(TravelCooldown(distance, table)).Sub(time.Now())
+	if wait < 0 {
+		return 0
+	}
+	return wait
+}
@@ -0,0 +1,324 @@
+package util
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/bits"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pogointel/opm/opm"
+)
+
+// Errors returned by verifiers
+var (
+	ErrVerificationMissing  = errors.New("Verification missing")
+	ErrVerificationFailed   = errors.New("Verification failed")
+	ErrVerificationExpired  = errors.New("Verification expired")
+	ErrVerificationReplayed = errors.New("Request was already used")
+)
+
+// Headers used by the verifiers. The values can also be sent as query parameters.
+const (
+	TokenHeader     = "X-OPM-Token"
+	KeyHeader       = "X-OPM-Key"
+	ChallengeHeader = "X-OPM-Challenge"
+	NonceHeader     = "X-OPM-Nonce"
+	SecretHeader    = "X-OPM-Secret" // Internal requests between OPM services
+)
+
+// maxSignatureAge is the maximum difference between the timestamp of a signed request and now
+const maxSignatureAge = 5 * time.Minute
+
+// Verifier checks if a request is allowed
+type Verifier interface {
+	Verify(r *http.Request) error
+}
+
+// VerifierOptions are used for creating the built-in verifiers
+type VerifierOptions struct {
+	Secret        string                           // Secret for signing tokens and challenges
+	TokenLifetime time.Duration                    // Lifetime of frontend tokens
+	Difficulty    int                              // Number of leading zero bits required for proof-of-work
+	ClientIP      func(*http.Request) string       // Resolves the client IP of a request
+	GetKey        func(string) (opm.APIKey, error) // Looks up API keys by their public key
+}
+
+// NewVerifier creates a built-in verifier by its name (token, signature or pow).
+// Tokens and challenges could be forged without a secret, so those verifiers need one.
+func NewVerifier(name string, options VerifierOptions) (Verifier, error) {
+	if (name == "token" || name == "pow") && options.Secret == "" {
+		return nil, fmt.Errorf("The %s verifier needs a secret", name)
+	}
+	switch name {
+	case "token":
+		return &TokenVerifier{options.Secret, options.TokenLifetime, options.ClientIP}, nil
+	case "signature":
+		return NewSignatureVerifier(options.Secret, options.GetKey), nil
+	case "pow":
+		return NewProofOfWorkVerifier(options.Secret, options.Difficulty), nil
+	}
+	return nil, fmt.Errorf("Unknown verifier: %s", name)
+}
+
+// RouteVerifiers selects verifiers by the path of a request.
+// A request is allowed, if any of the verifiers for its route accepts it.
+// Routes without verifiers are always allowed.
+type RouteVerifiers map[string][]Verifier
+
+// NewRouteVerifiers creates the verifiers for every route in config (route -> verifier names)
+func NewRouteVerifiers(config map[string][]string, options VerifierOptions) (RouteVerifiers, error) {
+	rv := make(RouteVerifiers)
+	cache := make(map[string]Verifier)
+	for route, names := range config {
+		for _, name := range names {
+			v, ok := cache[name]
+			if !ok {
+				var err error
+				v, err = NewVerifier(name, options)
+				if err != nil {
+					return nil, err
+				}
+				cache[name] = v
+			}
+			rv[route] = append(rv[route], v)
+		}
+	}
+	return rv, nil
+}
+
+// Verify checks the request with the verifiers of its route
+func (rv RouteVerifiers) Verify(r *http.Request) error {
+	verifiers := rv[r.URL.Path]
+	if len(verifiers) == 0 {
+		return nil
+	}
+	var err error
+	for _, v := range verifiers {
+		if err = v.Verify(r); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// Internal checks if the request carries the secret in the SecretHeader (e.g. scans of the apiserver's scan jobs).
+// Without a secret no request is internal.
+func Internal(r *http.Request, secret string) bool {
+	return secret != "" && hmac.Equal([]byte(r.Header.Get(SecretHeader)), []byte(secret))
+}
+
+// requestValue returns a value from the header or the query string of a request.
+// The body is never parsed, so requests can still be proxied afterwards.
+func requestValue(r *http.Request, header, param string) string {
+	if v := r.Header.Get(header); v != "" {
+		return v
+	}
+	return r.URL.Query().Get(param)
+}
+
+// TokenVerifier accepts requests with a signed token that was issued to the client IP (e.g. for the frontend).
+// Tokens look like <expiry>.<signature>.
+type TokenVerifier struct {
+	Secret   string
+	Lifetime time.Duration
+	ClientIP func(*http.Request) string
+}
+
+// Issue creates a new token for the client of the request
+func (t *TokenVerifier) Issue(r *http.Request) (string, int64) {
+	expiry := time.Now().Add(t.Lifetime).Unix()
+	return fmt.Sprintf("%d.%s", expiry, opm.Sign(t.Secret, expiry, []byte(t.ClientIP(r)))), expiry
+}
+
+// Verify checks the token of the request
+func (t *TokenVerifier) Verify(r *http.Request) error {
+	token := requestValue(r, TokenHeader, "token")
+	if token == "" {
+		return ErrVerificationMissing
+	}
+	parts := strings.SplitN(token, ".", 2)
+	if len(parts) != 2 {
+		return ErrVerificationFailed
+	}
+	expiry, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return ErrVerificationFailed
+	}
+	if !opm.CheckSignature(t.Secret, expiry, []byte(t.ClientIP(r)), parts[1]) {
+		return ErrVerificationFailed
+	}
+	if expiry < time.Now().Unix() {
+		return ErrVerificationExpired
+	}
+	return nil
+}
+
+// SignatureVerifier accepts requests that are signed by an enabled API key.
+// The signature is the HMAC of the timestamp and the body with the hash of the private key (see opm.Sign and opm.HashKey).
+// Every signature is only accepted once.
+type SignatureVerifier struct {
+	Secret string // Server secret for opening the sealed signing secrets of the keys
+	GetKey func(string) (opm.APIKey, error)
+	lock   sync.Mutex
+	seen   map[string]int64
+	pruned int64
+}
+
+// NewSignatureVerifier creates a new SignatureVerifier
+func NewSignatureVerifier(secret string, getKey func(string) (opm.APIKey, error)) *SignatureVerifier {
+	return &SignatureVerifier{Secret: secret, GetKey: getKey, seen: make(map[string]int64)}
+}
+
+// Signed checks if the request carries a signature
+func (s *SignatureVerifier) Signed(r *http.Request) bool {
+	return r.Header.Get(opm.SignatureHeader) != ""
+}
+
+// Verify checks the signature of the request
+func (s *SignatureVerifier) Verify(r *http.Request) error {
+	_, err := s.VerifyKey(r)
+	return err
+}
+
+// VerifyKey checks the signature of the request and returns the API key that signed it
+func (s *SignatureVerifier) VerifyKey(r *http.Request) (opm.APIKey, error) {
+	public := requestValue(r, KeyHeader, "key")
+	signature := r.Header.Get(opm.SignatureHeader)
+	if public == "" || signature == "" {
+		return opm.APIKey{}, ErrVerificationMissing
+	}
+	timestamp, err := strconv.ParseInt(r.Header.Get(opm.TimestampHeader), 10, 64)
+	if err != nil {
+		return opm.APIKey{}, ErrVerificationFailed
+	}
+	age := time.Since(time.Unix(timestamp, 0))
+	if age > maxSignatureAge || age < -maxSignatureAge {
+		return opm.APIKey{}, ErrVerificationExpired
+	}
+	key, err := s.GetKey(public)
+	if err != nil || !key.Enabled {
+		return key, ErrVerificationFailed
+	}
+	// Read body and put it back for the handler
+	var body []byte
+	if r.Body != nil {
+		body, err = ioutil.ReadAll(r.Body)
+		if err != nil {
+			return key, ErrVerificationFailed
+		}
+		r.Body.Close()
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	signingKey, err := key.SigningKey(s.Secret)
+	if err != nil || !opm.CheckSignature(signingKey, timestamp, body, signature) {
+		return key, ErrVerificationFailed
+	}
+	// Replay protection. Signatures older than maxSignatureAge are rejected anyway.
+	now := time.Now().Unix()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.pruned < now-60 {
+		for sig, expiry := range s.seen {
+			if expiry < now {
+				delete(s.seen, sig)
+			}
+		}
+		s.pruned = now
+	}
+	if _, ok := s.seen[signature]; ok {
+		return key, ErrVerificationReplayed
+	}
+	s.seen[signature] = timestamp + int64(maxSignatureAge/time.Second)
+	return key, nil
+}
+
+// ProofOfWorkVerifier accepts requests with a solved challenge.
+// A solution is a nonce for which sha256(challenge + nonce) starts with Difficulty zero bits.
+// Every challenge can only be used once.
+type ProofOfWorkVerifier struct {
+	Secret     string
+	Difficulty int
+	lock       sync.Mutex
+	used       map[string]int64
+	pruned     int64
+}
+
+// NewProofOfWorkVerifier creates a new ProofOfWorkVerifier
+func NewProofOfWorkVerifier(secret string, difficulty int) *ProofOfWorkVerifier {
+	return &ProofOfWorkVerifier{Secret: secret, Difficulty: difficulty, used: make(map[string]int64)}
+}
+
+// challengeLifetime is the time a client has for solving a challenge
+const challengeLifetime = 2 * time.Minute
+
+// Challenge creates a new challenge. Challenges look like <expiry>.<random>.<signature>.
+func (p *ProofOfWorkVerifier) Challenge() (string, int64) {
+	expiry := time.Now().Add(challengeLifetime).Unix()
+	b := make([]byte, 8)
+	rand.Read(b)
+	random := hex.EncodeToString(b)
+	return fmt.Sprintf("%d.%s.%s", expiry, random, opm.Sign(p.Secret, expiry, []byte(random))), expiry
+}
+
+// Verify checks the solved challenge of the request
+func (p *ProofOfWorkVerifier) Verify(r *http.Request) error {
+	challenge := requestValue(r, ChallengeHeader, "challenge")
+	nonce := requestValue(r, NonceHeader, "nonce")
+	if challenge == "" || nonce == "" {
+		return ErrVerificationMissing
+	}
+	parts := strings.SplitN(challenge, ".", 3)
+	if len(parts) != 3 {
+		return ErrVerificationFailed
+	}
+	expiry, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || !opm.CheckSignature(p.Secret, expiry, []byte(parts[1]), parts[2]) {
+		return ErrVerificationFailed
+	}
+	now := time.Now().Unix()
+	if expiry < now {
+		return ErrVerificationExpired
+	}
+	// Check work
+	hash := sha256.Sum256([]byte(challenge + nonce))
+	if leadingZeroBits(hash[:]) < p.Difficulty {
+		return ErrVerificationFailed
+	}
+	// Don't accept the same challenge twice. Expired challenges are rejected anyway.
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.pruned < now-60 {
+		for c, e := range p.used {
+			if e < now {
+				delete(p.used, c)
+			}
+		}
+		p.pruned = now
+	}
+	if _, ok := p.used[challenge]; ok {
+		return ErrVerificationFailed
+	}
+	p.used[challenge] = expiry
+	return nil
+}
+
+func leadingZeroBits(b []byte) int {
+	count := 0
+	for _, v := range b {
+		if v != 0 {
+			return count + bits.LeadingZeros8(v)
+		}
+		count += 8
+	}
+	return count
+}